@@ -184,6 +184,9 @@ func (client *DockerClient) ContainerLogs(id string, options *LogOptions) (io.Re
 	if options.Tail > 0 {
 		v.Add("tail", strconv.FormatInt(options.Tail, 10))
 	}
+	if options.Since > 0 {
+		v.Add("since", strconv.FormatInt(options.Since, 10))
+	}
 
 	uri := fmt.Sprintf("/%s/containers/%s/logs?%s", APIVersion, id, v.Encode())
 	req, err := http.NewRequest("GET", client.URL.String()+uri, nil)
@@ -254,11 +257,16 @@ func (client *DockerClient) KillContainer(id, signal string) error {
 
 func (client *DockerClient) StartMonitorEvents(cb Callback, ec chan error, args ...interface{}) {
 	atomic.StoreInt32(&client.monitorEvents, 1)
-	go client.getEvents(cb, ec, args...)
+	go client.getEvents("", cb, ec, args...)
 }
 
-func (client *DockerClient) getEvents(cb Callback, ec chan error, args ...interface{}) {
-	uri := fmt.Sprintf("%s/%s/events", client.URL.String(), APIVersion)
+func (client *DockerClient) StartMonitorEventsSince(since int64, cb Callback, ec chan error, args ...interface{}) {
+	atomic.StoreInt32(&client.monitorEvents, 1)
+	go client.getEvents(fmt.Sprintf("?since=%d", since), cb, ec, args...)
+}
+
+func (client *DockerClient) getEvents(query string, cb Callback, ec chan error, args ...interface{}) {
+	uri := fmt.Sprintf("%s/%s/events%s", client.URL.String(), APIVersion, query)
 	resp, err := client.HTTPClient.Get(uri)
 	if err != nil {
 		ec <- err
@@ -444,3 +452,225 @@ func (client *DockerClient) Exec(config *ExecConfig) (string, error) {
 	}
 	return createExecResp.Id, nil
 }
+
+func (client *DockerClient) UpdateContainer(id string, config *UpdateConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("/%s/containers/%s/update", APIVersion, id)
+	_, err = client.doRequest("POST", uri, data, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (client *DockerClient) WaitContainer(id string) (int, error) {
+	uri := fmt.Sprintf("/%s/containers/%s/wait", APIVersion, id)
+	data, err := client.doRequest("POST", uri, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	var result struct {
+		StatusCode int
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return -1, err
+	}
+	return result.StatusCode, nil
+}
+
+func (client *DockerClient) CommitContainer(id, repo, tag string, config *ContainerConfig) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("container", id)
+	v.Set("repo", repo)
+	v.Set("tag", tag)
+	uri := fmt.Sprintf("/%s/commit?%s", APIVersion, v.Encode())
+	data, err = client.doRequest("POST", uri, data, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Id string
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	return result.Id, nil
+}
+
+func (client *DockerClient) TopContainer(id, psArgs string) (*ContainerProcessList, error) {
+	v := url.Values{}
+	if psArgs != "" {
+		v.Set("ps_args", psArgs)
+	}
+	uri := fmt.Sprintf("/%s/containers/%s/top?%s", APIVersion, id, v.Encode())
+	data, err := client.doRequest("GET", uri, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := &ContainerProcessList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (client *DockerClient) ListVolumes() ([]*Volume, error) {
+	uri := fmt.Sprintf("/%s/volumes", APIVersion)
+	data, err := client.doRequest("GET", uri, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var volumesList VolumesListResponse
+	if err := json.Unmarshal(data, &volumesList); err != nil {
+		return nil, err
+	}
+	return volumesList.Volumes, nil
+}
+
+func (client *DockerClient) ListNetworks(filters string) ([]*NetworkResource, error) {
+	uri := fmt.Sprintf("/%s/networks", APIVersion)
+	if filters != "" {
+		uri += "?filters=" + url.QueryEscape(filters)
+	}
+	data, err := client.doRequest("GET", uri, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*NetworkResource{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (client *DockerClient) CreateNetwork(config *NetworkCreate) (*NetworkCreateResponse, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("/%s/networks/create", APIVersion)
+	data, err = client.doRequest("POST", uri, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	ret := &NetworkCreateResponse{}
+	err = json.Unmarshal(data, ret)
+	return ret, err
+}
+
+func (client *DockerClient) RemoveNetwork(id string) error {
+	uri := fmt.Sprintf("/%s/networks/%s", APIVersion, id)
+	_, err := client.doRequest("DELETE", uri, nil, nil)
+	return err
+}
+
+func (client *DockerClient) ConnectNetwork(id, container string) error {
+	data, err := json.Marshal(NetworkConnect{Container: container})
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("/%s/networks/%s/connect", APIVersion, id)
+	_, err = client.doRequest("POST", uri, data, nil)
+	return err
+}
+
+func (client *DockerClient) DisconnectNetwork(id, container string, force bool) error {
+	data, err := json.Marshal(NetworkDisconnect{Container: container, Force: force})
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("/%s/networks/%s/disconnect", APIVersion, id)
+	_, err = client.doRequest("POST", uri, data, nil)
+	return err
+}
+
+func (client *DockerClient) PutArchive(id, path string, content io.Reader) error {
+	v := url.Values{}
+	v.Set("path", path)
+	uri := fmt.Sprintf("/%s/containers/%s/archive?%s", APIVersion, id, v.Encode())
+	req, err := http.NewRequest("PUT", client.URL.String()+uri, content)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-tar")
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return Error{StatusCode: resp.StatusCode, Status: resp.Status, msg: string(data)}
+	}
+	return nil
+}
+
+func (client *DockerClient) GetArchive(id, path string) (io.ReadCloser, error) {
+	v := url.Values{}
+	v.Set("path", path)
+	uri := fmt.Sprintf("/%s/containers/%s/archive?%s", APIVersion, id, v.Encode())
+	req, err := http.NewRequest("GET", client.URL.String()+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, Error{StatusCode: resp.StatusCode, Status: resp.Status, msg: string(data)}
+	}
+	return resp.Body, nil
+}
+
+func (client *DockerClient) RemoveVolume(name string, force bool) error {
+	uri := fmt.Sprintf("/%s/volumes/%s?force=%t", APIVersion, name, force)
+	_, err := client.doRequest("DELETE", uri, nil, nil)
+	return err
+}
+
+func (client *DockerClient) Ping() error {
+	uri := "/_ping"
+	_, err := client.doRequest("GET", uri, nil, nil)
+	return err
+}
+
+// ContainerStats returns the stream of the stats of a container, one JSON
+// document per sample. Closing the stream ends it.
+func (client *DockerClient) ContainerStats(id string) (io.ReadCloser, error) {
+	uri := fmt.Sprintf("/%s/containers/%s/stats", APIVersion, id)
+	req, err := http.NewRequest("GET", client.URL.String()+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, Error{StatusCode: resp.StatusCode, Status: resp.Status, msg: string(data)}
+	}
+	return resp.Body, nil
+}
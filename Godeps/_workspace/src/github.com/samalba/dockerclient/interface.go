@@ -21,6 +21,7 @@ type Client interface {
 	RestartContainer(id string, timeout int) error
 	KillContainer(id, signal string) error
 	StartMonitorEvents(cb Callback, ec chan error, args ...interface{})
+	StartMonitorEventsSince(since int64, cb Callback, ec chan error, args ...interface{})
 	StopAllMonitorEvents()
 	StartMonitorStats(id string, cb StatCallback, ec chan error, args ...interface{})
 	StopAllMonitorStats()
@@ -32,4 +33,19 @@ type Client interface {
 	RemoveImage(name string) ([]*ImageDelete, error)
 	PauseContainer(name string) error
 	UnpauseContainer(name string) error
+	UpdateContainer(id string, config *UpdateConfig) error
+	WaitContainer(id string) (int, error)
+	CommitContainer(id, repo, tag string, config *ContainerConfig) (string, error)
+	TopContainer(id, psArgs string) (*ContainerProcessList, error)
+	ListVolumes() ([]*Volume, error)
+	ListNetworks(filters string) ([]*NetworkResource, error)
+	CreateNetwork(config *NetworkCreate) (*NetworkCreateResponse, error)
+	RemoveNetwork(id string) error
+	ConnectNetwork(id, container string) error
+	DisconnectNetwork(id, container string, force bool) error
+	PutArchive(id, path string, content io.Reader) error
+	GetArchive(id, path string) (io.ReadCloser, error)
+	RemoveVolume(name string, force bool) error
+	Ping() error
+	ContainerStats(id string) (io.ReadCloser, error)
 }
@@ -69,6 +69,10 @@ func (client *MockClient) StartMonitorEvents(cb dockerclient.Callback, ec chan e
 	client.Mock.Called(cb, ec, args)
 }
 
+func (client *MockClient) StartMonitorEventsSince(since int64, cb dockerclient.Callback, ec chan error, args ...interface{}) {
+	client.Mock.Called(since, cb, ec, args)
+}
+
 func (client *MockClient) StopAllMonitorEvents() {
 	client.Mock.Called()
 }
@@ -125,3 +129,78 @@ func (client *MockClient) Exec(config *dockerclient.ExecConfig) (string, error)
 	args := client.Mock.Called(config)
 	return args.String(0), args.Error(1)
 }
+
+func (client *MockClient) UpdateContainer(id string, config *dockerclient.UpdateConfig) error {
+	args := client.Mock.Called(id, config)
+	return args.Error(0)
+}
+
+func (client *MockClient) WaitContainer(id string) (int, error) {
+	args := client.Mock.Called(id)
+	return args.Int(0), args.Error(1)
+}
+
+func (client *MockClient) CommitContainer(id, repo, tag string, config *dockerclient.ContainerConfig) (string, error) {
+	args := client.Mock.Called(id, repo, tag, config)
+	return args.String(0), args.Error(1)
+}
+
+func (client *MockClient) TopContainer(id, psArgs string) (*dockerclient.ContainerProcessList, error) {
+	args := client.Mock.Called(id, psArgs)
+	return args.Get(0).(*dockerclient.ContainerProcessList), args.Error(1)
+}
+
+func (client *MockClient) ListVolumes() ([]*dockerclient.Volume, error) {
+	args := client.Mock.Called()
+	return args.Get(0).([]*dockerclient.Volume), args.Error(1)
+}
+
+func (client *MockClient) ListNetworks(filters string) ([]*dockerclient.NetworkResource, error) {
+	args := client.Mock.Called(filters)
+	return args.Get(0).([]*dockerclient.NetworkResource), args.Error(1)
+}
+
+func (client *MockClient) CreateNetwork(config *dockerclient.NetworkCreate) (*dockerclient.NetworkCreateResponse, error) {
+	args := client.Mock.Called(config)
+	return args.Get(0).(*dockerclient.NetworkCreateResponse), args.Error(1)
+}
+
+func (client *MockClient) RemoveNetwork(id string) error {
+	args := client.Mock.Called(id)
+	return args.Error(0)
+}
+
+func (client *MockClient) ConnectNetwork(id, container string) error {
+	args := client.Mock.Called(id, container)
+	return args.Error(0)
+}
+
+func (client *MockClient) DisconnectNetwork(id, container string, force bool) error {
+	args := client.Mock.Called(id, container, force)
+	return args.Error(0)
+}
+
+func (client *MockClient) PutArchive(id, path string, content io.Reader) error {
+	args := client.Mock.Called(id, path, content)
+	return args.Error(0)
+}
+
+func (client *MockClient) GetArchive(id, path string) (io.ReadCloser, error) {
+	args := client.Mock.Called(id, path)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
+func (client *MockClient) RemoveVolume(name string, force bool) error {
+	args := client.Mock.Called(name, force)
+	return args.Error(0)
+}
+
+func (client *MockClient) Ping() error {
+	args := client.Mock.Called()
+	return args.Error(0)
+}
+
+func (client *MockClient) ContainerStats(id string) (io.ReadCloser, error) {
+	args := client.Mock.Called(id)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
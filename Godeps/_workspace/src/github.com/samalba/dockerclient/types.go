@@ -10,6 +10,8 @@ type ContainerConfig struct {
 	MemorySwap      int64
 	CpuShares       int64
 	Cpuset          string
+	CpusetCpus      string
+	CpusetMems      string
 	AttachStdin     bool
 	AttachStdout    bool
 	AttachStderr    bool
@@ -46,6 +48,16 @@ type HostConfig struct {
 	SecurityOpt     []string
 	NetworkMode     string
 	RestartPolicy   RestartPolicy
+	DeviceRequests  []DeviceRequest
+	Runtime         string
+}
+
+type DeviceRequest struct {
+	Driver       string
+	Count        int
+	DeviceIDs    []string
+	Capabilities [][]string
+	Options      map[string]string
 }
 
 type ExecConfig struct {
@@ -64,6 +76,7 @@ type LogOptions struct {
 	Stderr     bool
 	Timestamps bool
 	Tail       int64
+	Since      int64
 }
 
 type RestartPolicy struct {
@@ -89,10 +102,12 @@ type ContainerInfo struct {
 		Paused     bool
 		Restarting bool
 		Pid        int
+		OOMKilled  bool
 		ExitCode   int
 		StartedAt  time.Time
 		FinishedAt time.Time
 		Ghost      bool
+		Health     *Health
 	}
 	Image           string
 	NetworkSettings struct {
@@ -105,9 +120,19 @@ type ContainerInfo struct {
 	SysInitPath    string
 	ResolvConfPath string
 	Volumes        map[string]string
+	Mounts         []MountPoint
 	HostConfig     *HostConfig
 }
 
+type MountPoint struct {
+	Name        string
+	Source      string
+	Destination string
+	Driver      string
+	Mode        string
+	RW          bool
+}
+
 type ContainerChanges struct {
 	Path string
 	Kind int
@@ -133,10 +158,11 @@ type Container struct {
 }
 
 type Event struct {
-	Id     string
-	Status string
-	From   string
-	Time   int64
+	Id       string
+	Status   string
+	From     string
+	Time     int64
+	TimeNano int64 `json:"timeNano"`
 }
 
 type Version struct {
@@ -170,8 +196,26 @@ type Info struct {
 	OperatingSystem string
 	NCPU            int64
 	MemTotal        int64
+	SwapLimit       bool
 	Name            string
 	Labels          []string
+	SecurityOptions []string
+	CgroupVersion   string
+	Plugins         PluginsInfo
+	Runtimes        map[string]Runtime
+	DefaultRuntime  string
+}
+
+type Runtime struct {
+	Path string   `json:"path"`
+	Args []string `json:"runtimeArgs,omitempty"`
+}
+
+type PluginsInfo struct {
+	Volume        []string
+	Network       []string
+	Authorization []string
+	Log           []string
 }
 
 type ImageDelete struct {
@@ -255,3 +299,74 @@ type Stats struct {
 	MemoryStats  MemoryStats  `json:"memory_stats,omitempty"`
 	BlkioStats   BlkioStats   `json:"blkio_stats,omitempty"`
 }
+
+type UpdateConfig struct {
+	Memory     int64
+	MemorySwap int64
+	CpuShares  int64
+}
+
+type ContainerProcessList struct {
+	Titles    []string
+	Processes [][]string
+}
+
+type Volume struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+}
+
+type VolumesListResponse struct {
+	Volumes []*Volume
+}
+
+type NetworkResource struct {
+	Name       string
+	ID         string `json:"Id"`
+	Scope      string
+	Driver     string
+	Containers map[string]EndpointResource
+	Options    map[string]string
+}
+
+type EndpointResource struct {
+	EndpointID  string
+	MacAddress  string
+	IPv4Address string
+	IPv6Address string
+}
+
+type NetworkCreate struct {
+	Name           string
+	CheckDuplicate bool
+	Driver         string
+	Options        map[string]interface{}
+}
+
+type NetworkCreateResponse struct {
+	ID      string `json:"Id"`
+	Warning string
+}
+
+type NetworkConnect struct {
+	Container string
+}
+
+type NetworkDisconnect struct {
+	Container string
+	Force     bool
+}
+
+type Health struct {
+	Status        string
+	FailingStreak int
+	Log           []*HealthcheckResult
+}
+
+type HealthcheckResult struct {
+	Start    time.Time
+	End      time.Time
+	ExitCode int
+	Output   string
+}
@@ -1,6 +1,46 @@
 package cluster
 
-import "github.com/samalba/dockerclient"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/samalba/dockerclient"
+)
+
+// SwarmIDLabel is set on every container created through swarm.
+const SwarmIDLabel = "com.docker.swarm.id"
+
+// Reservation labels override the limits of a container when accounting for
+// the resources of an engine: memory in bytes and number of CPUs.
+const (
+	MemoryReservationLabel = "com.docker.swarm.reservations.memory"
+	CpuReservationLabel    = "com.docker.swarm.reservations.cpus"
+)
+
+// IdempotencyKeyLabel makes creates safe to retry: a create whose key is the
+// one of an existing container returns that container instead of creating a
+// new one.
+const IdempotencyKeyLabel = "com.docker.swarm.idempotency-key"
+
+// CpusLabel records the number of CPUs of the engine when the container was
+// created, the CPU shares of the container are scaled by it.
+const CpusLabel = "com.docker.swarm.cpus"
+
+// RestartLabel marks the containers that should be running: when set to true,
+// the container is restarted if found stopped after its engine reconnects.
+// See Engine.SetReconcileOnReconnect.
+const RestartLabel = "com.docker.swarm.restart"
+
+// Normalized container states.
+const (
+	StateRunning    = "running"
+	StatePaused     = "paused"
+	StateRestarting = "restarting"
+	StateCreated    = "created"
+	StateExited     = "exited"
+)
 
 // Container is exported
 type Container struct {
@@ -9,3 +49,143 @@ type Container struct {
 	Info   dockerclient.ContainerInfo
 	Engine *Engine
 }
+
+// State returns the normalized state of the container.
+func (c *Container) State() string {
+	switch {
+	case c.Info.State.Paused:
+		return StatePaused
+	case c.Info.State.Restarting:
+		return StateRestarting
+	case c.Info.State.Running:
+		return StateRunning
+	case c.Info.State.StartedAt.IsZero():
+		// Created but never started.
+		return StateCreated
+	}
+	return StateExited
+}
+
+// Health returns the health status of the container ("starting", "healthy"
+// or "unhealthy"), or an empty string if it has no health check.
+func (c *Container) Health() string {
+	if c.Info.State.Health == nil {
+		return ""
+	}
+	return c.Info.State.Health.Status
+}
+
+// Return true if the container carries a restart intent.
+func (c *Container) restartIntent() bool {
+	if c.Info.Config == nil {
+		return false
+	}
+	restart, err := strconv.ParseBool(c.Info.Config.Labels[RestartLabel])
+	return err == nil && restart
+}
+
+// WasOOMKilled returns true if the last run of the container was killed for
+// running out of memory.
+func (c *Container) WasOOMKilled() bool {
+	return c.Info.State.OOMKilled
+}
+
+// Volumes returns the volumes mounted in the container: the name of named
+// volumes, the source of bind mounts.
+func (c *Container) Volumes() []string {
+	volumes := []string{}
+	for _, mount := range c.Info.Mounts {
+		if mount.Name != "" {
+			volumes = append(volumes, mount.Name)
+		} else if mount.Source != "" {
+			volumes = append(volumes, mount.Source)
+		}
+	}
+	return volumes
+}
+
+// Label returns the value of the label key of the container, and whether
+// the container has it.
+func (c *Container) Label(key string) (string, bool) {
+	if c.Info.Config == nil {
+		return "", false
+	}
+	value, exists := c.Info.Config.Labels[key]
+	return value, exists
+}
+
+// SwarmID returns the ID assigned by swarm to the container, if any.
+func (c *Container) SwarmID() string {
+	if c.Info.Config == nil {
+		return ""
+	}
+	return c.Info.Config.Labels[SwarmIDLabel]
+}
+
+// ReservedMemory returns the memory reserved by the container: its memory
+// reservation label if set, its memory limit otherwise.
+func (c *Container) ReservedMemory() int64 {
+	if c.Info.Config == nil {
+		return 0
+	}
+	return reservation(c.Info.Config, MemoryReservationLabel, c.Info.Config.Memory)
+}
+
+// ReservedMemorySwap returns the memory + swap reserved by the container:
+// its reserved memory (see ReservedMemory) plus the swap allowed by its
+// memory swap limit, as much swap as memory when unset as docker does.
+// Containers with unlimited swap (-1) reserve no swap, only their memory.
+func (c *Container) ReservedMemorySwap() int64 {
+	if c.Info.Config == nil {
+		return 0
+	}
+	memory := c.ReservedMemory()
+	switch swap := c.Info.Config.MemorySwap; {
+	case swap == -1, c.Info.Config.Memory == 0:
+		return memory
+	case swap == 0:
+		return 2 * memory
+	default:
+		return memory + swap - c.Info.Config.Memory
+	}
+}
+
+// ReservedCpus returns the CPUs reserved by the container: its CPU
+// reservation label if set, its CPU shares otherwise.
+func (c *Container) ReservedCpus() int64 {
+	if c.Info.Config == nil {
+		return 0
+	}
+	return reservation(c.Info.Config, CpuReservationLabel, c.Info.Config.CpuShares)
+}
+
+// Return the reservation from the label of config, or limit if there is
+// none.
+func reservation(config *dockerclient.ContainerConfig, label string, limit int64) int64 {
+	value, exists := config.Labels[label]
+	if !exists {
+		return limit
+	}
+	reserved, err := parseReservation(value)
+	if err != nil {
+		return limit
+	}
+	return reserved
+}
+
+func parseReservation(value string) (int64, error) {
+	reserved, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || reserved < 0 {
+		return 0, fmt.Errorf("invalid reservation %q", value)
+	}
+	return reserved, nil
+}
+
+// Generate a random 64 characters long hexadecimal ID.
+func generateID() string {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -2,11 +2,19 @@ package cluster
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -17,20 +25,110 @@ const (
 	// Force-refresh the state of the engine this often.
 	stateRefreshPeriod = 30 * time.Second
 
-	// Timeout for requests sent out to the engine.
-	requestTimeout = 10 * time.Second
+	// Spread the refreshes of the engines by up to this fraction of the
+	// refresh period, either way, so that they don't all hit at once.
+	defaultRefreshJitter = 0.1
+
+	// Inspect this many containers in parallel when refreshing the state.
+	defaultInspectConcurrency = 8
+
+	// Buffer this many events for each subscriber before dropping them.
+	subscriptionBuffer = 100
+)
+
+var (
+	// ErrNameConflict is returned when creating a container with a name
+	// already used on the engine.
+	ErrNameConflict = errors.New("container name already in use")
+
+	// ErrAlreadyConnected is returned when connecting an engine twice.
+	ErrAlreadyConnected = errors.New("engine already connected")
+
+	// ErrNotConnected is returned when using an engine which is not
+	// connected.
+	ErrNotConnected = errors.New("engine is not connected")
+
+	// ErrContainerNotFound is returned when a container is not known to the
+	// engine.
+	ErrContainerNotFound = errors.New("container not found")
+
+	// ErrContainerAlreadyExists is returned when adding a container already
+	// known to the engine.
+	ErrContainerAlreadyExists = errors.New("container already exists")
+
+	// ErrImageNotFound is returned when an image is not present on the
+	// engine.
+	ErrImageNotFound = errors.New("image not found")
+
+	// ErrCordoned is returned when creating a container on a cordoned engine.
+	ErrCordoned = errors.New("engine is cordoned")
+
+	// ErrShutdown is returned when operating an engine being shut down.
+	ErrShutdown = errors.New("engine is shutting down")
+
+	// ErrEventHandlerAlreadySet is returned when registering a second event
+	// handler.
+	ErrEventHandlerAlreadySet = errors.New("event handler already set")
+
+	// ErrEventsNotPaused is returned when resuming events without a
+	// matching pause.
+	ErrEventsNotPaused = errors.New("events are not paused")
+
+	// ErrNoFit is returned when scoring an engine without room for the
+	// container.
+	ErrNoFit = errors.New("not enough resources on the engine")
 )
 
+// Timeout for connecting to the engine. It only bounds establishing the
+// connection, the requests themselves (e.g. long pulls) are not limited so
+// they are not killed halfway. Overridden in tests.
+var connectTimeout = 10 * time.Second
+
+// Period of the TCP keep-alive probes of the connections to the engines, so
+// that connections silently dropped on the way (e.g. by a load balancer) are
+// detected rather than hanging the next request.
+const tcpKeepAlive = 30 * time.Second
+
+// newClient builds a client to the docker engine at addr. Overridden in tests.
+var newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+	client, err := dockerclient.NewDockerClientTimeout("tcp://"+addr, config, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		transport.Dial = newDialer().Dial
+	}
+	return client, nil
+}
+
+// newDialer builds the dialer of the connections to the engines. Overridden
+// in tests.
+var newDialer = func() *net.Dialer {
+	return &net.Dialer{Timeout: connectTimeout, KeepAlive: tcpKeepAlive}
+}
+
 // NewEngine is exported
 func NewEngine(addr string, overcommitRatio float64) *Engine {
 	e := &Engine{
 		Addr:            addr,
 		Labels:          make(map[string]string),
 		ch:              make(chan bool),
+		stop:            make(chan struct{}),
+		refreshRequests: make(chan chan error),
 		containers:      make(map[string]*Container),
+		restarts:        make(map[string]int),
+		lastEvents:      make(map[string]*lastEvent),
+		inspects:        make(map[string]*inspectCall),
+		pulls:           make(map[string]*pullCall),
 		healthy:         true,
 		overcommitRatio: int64(overcommitRatio * 100),
+		maxInspects:     defaultInspectConcurrency,
+		refreshJitter:   defaultRefreshJitter,
+		clock:           realClock{},
+		retries:         defaultClientRetries,
+		retryBackoff:    defaultRetryBackoff,
 	}
+	e.healthCond = sync.NewCond(&e.healthLock)
 	return e
 }
 
@@ -47,17 +145,95 @@ type Engine struct {
 	Labels map[string]string
 
 	ch              chan bool
+	stop            chan struct{}
+	refreshRequests chan chan error
+	refreshDone     chan struct{}
 	containers      map[string]*Container
+	volumeUsers     map[string]map[string]bool
+	restarts        map[string]int
+	lastEvents      map[string]*lastEvent
+	lastEventTime   int64
+	daemonLabels    map[string]string
+	manualLabels    map[string]string
+	capabilities    map[string]bool
+	info            *dockerclient.Info
 	images          []*Image
+	imagesRefreshed bool
+	volumes         []*Volume
+	networks        []*Network
 	client          dockerclient.Client
+	tlsConfig       *tls.Config
 	eventHandler    EventHandler
+	eventFilter     map[string]bool
+	subscribers     map[chan *Event]struct{}
 	healthy         bool
-	overcommitRatio int64
+	cordoned        bool
+	shutdown        bool
+	reserveStopped  bool
+	overcommitted   bool
+	pendingCpus     int64
+	pendingMemory   int64
+	eventsPaused    int
+	lastUpdate      time.Time
+	unhealthySince  time.Time
+
+	reconnectAttempts    int
+	maxReconnectAttempts int
+	reconcileOnReconnect bool
+	imageRefreshDisabled bool
+	overcommitRatio      int64
+	maxInspects          int
+	maxContainers        int
+	refreshJitter        float64
+	eventsWindow         time.Duration
+	pingPeriod           time.Duration
+	eventsSeen           time.Time
+	clock                clock
+	retries              int
+	retryBackoff         time.Duration
+	lockObserver         func(op string, wait, held time.Duration)
+	limiter              *rateLimiter
+	createHook           CreateHook
+	defaultTag           string
+	credentials          CredentialProvider
+
+	inspects     map[string]*inspectCall
+	inspectsLock sync.Mutex
+	pulls        map[string]*pullCall
+	pullsLock    sync.Mutex
+	eventsLock   sync.RWMutex
+	operations   sync.WaitGroup
+	healthLock   sync.Mutex
+	clientLock   sync.RWMutex
+	connectLock  sync.Mutex
+	healthCond   *sync.Cond
+}
+
+// pullCall is an in-flight image pull.
+type pullCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// inspectCall is an in-flight container inspect.
+type inspectCall struct {
+	wg   sync.WaitGroup
+	info *dockerclient.ContainerInfo
+	err  error
 }
 
 // Connect will initialize a connection to the Docker daemon running on the
 // host, gather machine specs (memory, cpu, ...) and monitor state changes.
 func (e *Engine) Connect(config *tls.Config) error {
+	// Concurrent connections wait for each other, only the first one
+	// connects.
+	e.connectLock.Lock()
+	defer e.connectLock.Unlock()
+
+	if e.isConnected() {
+		return ErrAlreadyConnected
+	}
+
 	host, _, err := net.SplitHostPort(e.Addr)
 	if err != nil {
 		return err
@@ -69,7 +245,10 @@ func (e *Engine) Connect(config *tls.Config) error {
 	}
 	e.IP = addr.IP.String()
 
-	c, err := dockerclient.NewDockerClientTimeout("tcp://"+e.Addr, config, time.Duration(requestTimeout))
+	// Keep the TLS config around, it is needed to reconnect.
+	e.tlsConfig = config
+
+	c, err := newClient(e.Addr, e.tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -78,48 +257,179 @@ func (e *Engine) Connect(config *tls.Config) error {
 }
 
 func (e *Engine) connectClient(client dockerclient.Client) error {
-	e.client = client
+	// A second refresh loop and event monitor would be started otherwise.
+	if !e.claimClient(e.limitClient(client)) {
+		return ErrAlreadyConnected
+	}
 
 	// Fetch the engine labels.
 	if err := e.updateSpecs(); err != nil {
-		e.client = nil
+		e.replaceClient(nil)
 		return err
 	}
 
 	// Force a state update before returning.
 	if err := e.refreshContainers(true); err != nil {
-		e.client = nil
+		e.replaceClient(nil)
 		return err
 	}
 
 	if err := e.RefreshImages(); err != nil {
-		e.client = nil
+		e.replaceClient(nil)
 		return err
 	}
 
-	// Start the update loop.
-	go e.refreshLoop()
+	done := make(chan struct{})
+	e.Lock()
+	e.lastUpdate = e.clock.Now()
+	e.refreshDone = done
+	e.Unlock()
+
+	// Start the update loop, Shutdown waits for it to stop.
+	e.operations.Add(1)
+	go func() {
+		defer e.operations.Done()
+		defer close(done)
+		e.refreshLoop()
+	}()
+	if e.pingPeriod > 0 {
+		e.operations.Add(1)
+		go func() {
+			defer e.operations.Done()
+			e.pingLoop()
+		}()
+	}
 
 	// Start monitoring events from the engine.
-	e.client.StartMonitorEvents(e.handler, nil)
+	e.startMonitorEvents()
 	e.emitEvent("engine_connect")
 
 	return nil
 }
 
+// Return the client of the engine, or an error if it is not connected.
+func (e *Engine) clientOrErr() (dockerclient.Client, error) {
+	e.clientLock.RLock()
+	client := e.client
+	e.clientLock.RUnlock()
+	if client == nil {
+		return nil, ErrNotConnected
+	}
+	return client, nil
+}
+
+// Swap the client of the engine for client, nil disconnecting the engine,
+// and return the previous one.
+func (e *Engine) replaceClient(client dockerclient.Client) dockerclient.Client {
+	e.clientLock.Lock()
+	defer e.clientLock.Unlock()
+	previous := e.client
+	e.client = client
+	return previous
+}
+
+// Install client unless the engine already has one, in a single step so that
+// concurrent connections can't both succeed. Return false if it has one.
+func (e *Engine) claimClient(client dockerclient.Client) bool {
+	e.clientLock.Lock()
+	defer e.clientLock.Unlock()
+	if e.client != nil {
+		return false
+	}
+	e.client = client
+	return true
+}
+
 // isConnected returns true if the engine is connected to a remote docker API
 func (e *Engine) isConnected() bool {
-	return e.client != nil
+	_, err := e.clientOrErr()
+	return err == nil
 }
 
 // IsHealthy returns true if the engine is healthy
 func (e *Engine) IsHealthy() bool {
+	e.healthLock.Lock()
+	defer e.healthLock.Unlock()
 	return e.healthy
 }
 
+// Flag the engine as healthy or not, waking up the goroutines waiting for it.
+func (e *Engine) setHealthy(healthy bool) {
+	e.healthLock.Lock()
+	e.healthy = healthy
+	e.healthCond.Broadcast()
+	e.healthLock.Unlock()
+}
+
+// WaitHealthy blocks until the engine is healthy, or returns an error once
+// timeout has elapsed.
+func (e *Engine) WaitHealthy(timeout time.Duration) error {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		e.healthLock.Lock()
+		expired = true
+		e.healthCond.Broadcast()
+		e.healthLock.Unlock()
+	})
+	defer timer.Stop()
+
+	e.healthLock.Lock()
+	defer e.healthLock.Unlock()
+	for !e.healthy {
+		if expired {
+			return fmt.Errorf("engine %s is still unhealthy after %s", e.Addr, timeout)
+		}
+		e.healthCond.Wait()
+	}
+	return nil
+}
+
+// Cordon stops the engine from accepting new containers, the existing ones
+// keep running and can still be managed.
+func (e *Engine) Cordon() {
+	e.Lock()
+	e.cordoned = true
+	e.Unlock()
+}
+
+// Uncordon lets the engine accept new containers again.
+func (e *Engine) Uncordon() {
+	e.Lock()
+	e.cordoned = false
+	e.Unlock()
+}
+
+// IsCordoned returns true if the engine refuses new containers.
+func (e *Engine) IsCordoned() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.cordoned
+}
+
+// LastUpdate returns the last time the state of the engine was successfully
+// refreshed.
+func (e *Engine) LastUpdate() time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	return e.lastUpdate
+}
+
+// UnhealthySince returns when the engine was flagged as unhealthy, or the
+// zero time if it is healthy.
+func (e *Engine) UnhealthySince() time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	return e.unhealthySince
+}
+
 // Gather engine specs (CPU, memory, constraints, ...).
 func (e *Engine) updateSpecs() error {
-	info, err := e.client.Info()
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	info, err := client.Info()
 	if err != nil {
 		return err
 	}
@@ -137,326 +447,2474 @@ func (e *Engine) updateSpecs() error {
 	e.Name = info.Name
 	e.Cpus = info.NCPU
 	e.Memory = info.MemTotal
-	e.Labels = map[string]string{
+	labels := map[string]string{
 		"storagedriver":   info.Driver,
 		"executiondriver": info.ExecutionDriver,
 		"kernelversion":   info.KernelVersion,
 		"operatingsystem": info.OperatingSystem,
 	}
 	for _, label := range info.Labels {
+		// Values may contain "=", only the first one separates the key.
 		kv := strings.SplitN(label, "=", 2)
-		e.Labels[kv[0]] = kv[1]
+		if len(kv) != 2 || !validLabelKey(kv[0]) {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Warnf("Ignoring invalid engine label %q", label)
+			continue
+		}
+		labels[kv[0]] = kv[1]
 	}
+
+	capabilities := infoCapabilities(info)
+
+	e.Lock()
+	defer e.Unlock()
+	e.info = info
+	e.capabilities = capabilities
+	e.daemonLabels = labels
+	e.mergeLabels()
 	return nil
 }
 
-// RemoveImage deletes an image from the engine.
-func (e *Engine) RemoveImage(image *Image) ([]*dockerclient.ImageDelete, error) {
-	return e.client.RemoveImage(image.Id)
+// Extract the capabilities of the engine from its info, see Capabilities.
+func infoCapabilities(info *dockerclient.Info) map[string]bool {
+	capabilities := make(map[string]bool)
+	for _, option := range info.SecurityOptions {
+		// Newer engines report options as "name=seccomp,profile=default".
+		if strings.HasPrefix(option, "name=") {
+			option = strings.SplitN(strings.TrimPrefix(option, "name="), ",", 2)[0]
+		}
+		capabilities[option] = true
+	}
+	if info.CgroupVersion != "" {
+		capabilities["cgroupv"+info.CgroupVersion] = true
+	}
+	for kind, plugins := range map[string][]string{
+		"volume":        info.Plugins.Volume,
+		"network":       info.Plugins.Network,
+		"authorization": info.Plugins.Authorization,
+		"log":           info.Plugins.Log,
+	} {
+		for _, plugin := range plugins {
+			capabilities[kind+"/"+plugin] = true
+		}
+	}
+	return capabilities
 }
 
-// RefreshImages refreshes the list of images on the engine.
-func (e *Engine) RefreshImages() error {
-	images, err := e.client.ListImages()
-	if err != nil {
-		return err
+// HasCapability returns true if the engine has the capability name, see
+// Capabilities.
+func (e *Engine) HasCapability(name string) bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.capabilities[name]
+}
+
+// HasRuntime returns true if the engine supports the container runtime name
+// (e.g. "runc").
+func (e *Engine) HasRuntime(name string) bool {
+	e.RLock()
+	defer e.RUnlock()
+	if e.info == nil {
+		return false
 	}
-	e.Lock()
-	e.images = nil
-	for _, image := range images {
-		e.images = append(e.images, &Image{Image: *image, Engine: e})
+	_, exists := e.info.Runtimes[name]
+	return exists
+}
+
+func (e *Engine) reportsRuntimes() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.info != nil && len(e.info.Runtimes) > 0
+}
+
+// DefaultRuntime returns the runtime of the containers of the engine which
+// don't request one, empty if the engine doesn't tell.
+func (e *Engine) DefaultRuntime() string {
+	e.RLock()
+	defer e.RUnlock()
+	if e.info == nil {
+		return ""
 	}
-	e.Unlock()
-	return nil
+	return e.info.DefaultRuntime
 }
 
-// Refresh the list and status of containers running on the engine. If `full` is
-// true, each container will be inspected.
-func (e *Engine) refreshContainers(full bool) error {
-	containers, err := e.client.ListContainers(true, false, "")
-	if err != nil {
-		return err
+// Capabilities returns the sorted capabilities of the engine: its security
+// options (e.g. "seccomp"), its cgroup version (e.g. "cgroupv2") and its
+// plugins as "type/name" (e.g. "volume/local").
+func (e *Engine) Capabilities() []string {
+	e.RLock()
+	defer e.RUnlock()
+
+	capabilities := make([]string, 0, len(e.capabilities))
+	for capability := range e.capabilities {
+		capabilities = append(capabilities, capability)
 	}
+	sort.Strings(capabilities)
+	return capabilities
+}
 
-	merged := make(map[string]*Container)
-	for _, c := range containers {
-		merged, err = e.updateContainer(c, merged, full)
-		if err != nil {
-			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to update state of container %q", c.Id)
-		}
+// SetLabel sets an engine label at runtime, it is kept across refreshes and
+// takes precedence over the labels of the daemon.
+func (e *Engine) SetLabel(key, value string) error {
+	if !validLabelKey(key) {
+		return fmt.Errorf("invalid label key %q", key)
 	}
 
 	e.Lock()
 	defer e.Unlock()
-	e.containers = merged
 
-	log.WithFields(log.Fields{"id": e.ID, "name": e.Name}).Debugf("Updated engine state")
+	if e.manualLabels == nil {
+		e.manualLabels = make(map[string]string)
+	}
+	e.manualLabels[key] = value
+	e.mergeLabels()
 	return nil
 }
 
-// Refresh the status of a container running on the engine. If `full` is true,
-// the container will be inspected.
-func (e *Engine) refreshContainer(ID string, full bool) error {
-	containers, err := e.client.ListContainers(true, false, fmt.Sprintf("{%q:[%q]}", "id", ID))
-	if err != nil {
-		return err
-	}
-
-	if len(containers) > 1 {
-		// We expect one container, if we get more than one, trigger a full refresh.
-		return e.refreshContainers(full)
-	}
+// RemoveLabel removes an engine label set through SetLabel. The label of the
+// daemon with the same key, if any, is restored.
+func (e *Engine) RemoveLabel(key string) {
+	e.Lock()
+	defer e.Unlock()
 
-	if len(containers) == 0 {
-		// The container doesn't exist on the engine, remove it.
-		e.Lock()
-		delete(e.containers, ID)
-		e.Unlock()
+	delete(e.manualLabels, key)
+	e.mergeLabels()
+}
 
-		return nil
+// Rebuild the public labels from the daemon and the manual ones, the latter
+// taking precedence. The labels map may be shared with readers, it is
+// replaced rather than updated in place. Must be called with the lock held.
+func (e *Engine) mergeLabels() {
+	labels := make(map[string]string, len(e.daemonLabels)+len(e.manualLabels))
+	for k, v := range e.daemonLabels {
+		labels[k] = v
 	}
-
-	_, err = e.updateContainer(containers[0], e.containers, full)
-	return err
+	for k, v := range e.manualLabels {
+		labels[k] = v
+	}
+	e.Labels = labels
 }
 
-func (e *Engine) updateContainer(c dockerclient.Container, containers map[string]*Container, full bool) (map[string]*Container, error) {
-	var container *Container
+// Return a copy of the engine labels. Must be called with the lock held.
+func (e *Engine) copyLabels() map[string]string {
+	labels := make(map[string]string, len(e.Labels)+1)
+	for k, v := range e.Labels {
+		labels[k] = v
+	}
+	return labels
+}
 
-	e.RLock()
-	if current, exists := e.containers[c.Id]; exists {
-		// The container is already knowe.
-		container = current
-	} else {
-		// This is a brand new container. We need to do a full refresh.
-		container = &Container{
-			Engine: e,
-		}
-		full = true
+// Info returns the raw info of the daemon, fetched fresh.
+func (e *Engine) Info() (*dockerclient.Info, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
 	}
-	// Release the lock here as the next step is slow.
-	// Trade-off: If updateContainer() is called concurrently for the same
-	// container, we will end up doing a full refresh twice and the original
-	// container (containers[container.Id]) will get replaced.
-	e.RUnlock()
 
-	// Update ContainerInfo.
-	if full {
-		info, err := e.client.InspectContainer(c.Id)
-		if err != nil {
-			return nil, err
-		}
-		container.Info = *info
-		// real CpuShares -> nb of CPUs
-		container.Info.Config.CpuShares = container.Info.Config.CpuShares * 1024.0 / e.Cpus
+	info, err := client.Info()
+	if err != nil {
+		return nil, err
 	}
 
-	// Update its internal state.
 	e.Lock()
-	container.Container = c
-	containers[container.Id] = container
+	e.info = info
 	e.Unlock()
+	return info, nil
+}
 
-	return containers, nil
+// LastInfo returns the raw info of the daemon as last fetched, without a
+// round trip to the daemon. It is nil until the engine is connected.
+func (e *Engine) LastInfo() *dockerclient.Info {
+	e.RLock()
+	defer e.RUnlock()
+	return e.info
 }
 
-func (e *Engine) refreshContainersAsync() {
-	e.ch <- true
+// Label keys must be non-empty and free of whitespace.
+func validLabelKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t\n\r")
 }
 
-func (e *Engine) refreshLoop() {
-	for {
-		var err error
-		select {
-		case <-e.ch:
-			err = e.refreshContainers(false)
-		case <-time.After(stateRefreshPeriod):
-			err = e.refreshContainers(false)
-		}
+// MatchLabel returns true if the engine label `key` matches `value`. The
+// value may contain "*" wildcards and is negated when prefixed with "!".
+func (e *Engine) MatchLabel(key, value string) bool {
+	negate := strings.HasPrefix(value, "!")
+	if negate {
+		value = value[1:]
+	}
 
-		if err == nil {
-			err = e.RefreshImages()
-		}
+	e.RLock()
+	label, exists := e.Labels[key]
+	e.RUnlock()
+	pattern := "^" + strings.Replace(regexp.QuoteMeta(value), `\*`, ".*", -1) + "$"
+	match := exists && regexp.MustCompile(pattern).MatchString(label)
 
-		if err != nil {
-			if e.healthy {
-				e.emitEvent("engine_disconnect")
-			}
-			e.healthy = false
-			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Flagging engine as dead. Updated state failed: %v", err)
-		} else {
-			if !e.healthy {
-				log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Info("Engine came back to life. Hooray!")
-				e.client.StopAllMonitorEvents()
-				e.client.StartMonitorEvents(e.handler, nil)
-				e.emitEvent("engine_reconnect")
-				if err := e.updateSpecs(); err != nil {
-					log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Update engine specs failed: %v", err)
-				}
-			}
-			e.healthy = true
-		}
-	}
+	return match != negate
 }
 
-func (e *Engine) emitEvent(event string) {
-	// If there is no event handler registered, abort right now.
-	if e.eventHandler == nil {
-		return
-	}
-	ev := &Event{
-		Event: dockerclient.Event{
-			Status: event,
-			From:   "swarm",
-			Time:   time.Now().Unix(),
-		},
-		Engine: e,
+// RemoveImage deletes an image from the engine.
+func (e *Engine) RemoveImage(image *Image) ([]*dockerclient.ImageDelete, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
 	}
-	e.eventHandler.Handle(ev)
+	return client.RemoveImage(image.Id)
 }
 
-// UsedMemory returns the sum of memory reserved by containers.
-func (e *Engine) UsedMemory() int64 {
-	var r int64
-	e.RLock()
-	for _, c := range e.containers {
-		r += c.Info.Config.Memory
+// RemoveImageSafe deletes an image from the engine, refusing to do so while
+// containers depend on it unless `force` is true.
+func (e *Engine) RemoveImageSafe(image *Image, force bool) ([]*dockerclient.ImageDelete, error) {
+	if !force {
+		if dependents := e.imageDependents(image); len(dependents) > 0 {
+			return nil, fmt.Errorf("image %s is used by containers %s", image.Id, strings.Join(dependents, ", "))
+		}
 	}
-	e.RUnlock()
-	return r
+	return e.RemoveImage(image)
 }
 
-// UsedCpus returns the sum of CPUs reserved by containers.
-func (e *Engine) UsedCpus() int64 {
-	var r int64
+// Return the IDs of the containers using an image.
+func (e *Engine) imageDependents(image *Image) []string {
 	e.RLock()
+	defer e.RUnlock()
+
+	dependents := []string{}
 	for _, c := range e.containers {
-		r += c.Info.Config.CpuShares
+		if c.Info.Image == image.Id || image.Match(c.Image) || (c.Info.Config != nil && image.Match(c.Info.Config.Image)) {
+			dependents = append(dependents, c.Id)
+		}
 	}
-	e.RUnlock()
-	return r
+	sort.Strings(dependents)
+	return dependents
 }
 
-// TotalMemory returns the total memory + overcommit
-func (e *Engine) TotalMemory() int64 {
-	return e.Memory + (e.Memory * e.overcommitRatio / 100)
+// RefreshImages refreshes the list of images on the engine.
+func (e *Engine) RefreshImages() error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	var images []*dockerclient.Image
+	err = e.retry(func() (err error) {
+		images, err = client.ListImages()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	unlock := e.observedLock("refresh_images")
+	old, initial := e.images, !e.imagesRefreshed
+	e.images = nil
+	for _, image := range images {
+		e.images = append(e.images, &Image{Image: *image, Engine: e})
+	}
+	e.imagesRefreshed = true
+	current := e.images
+	unlock()
+
+	// Nothing changed on the first refresh, the images were just unknown.
+	if !initial {
+		e.emitImageChanges(old, current)
+	}
+	return nil
 }
 
-// TotalCpus returns the total cpus + overcommit
-func (e *Engine) TotalCpus() int64 {
-	return e.Cpus + (e.Cpus * e.overcommitRatio / 100)
+// Emit an image_added or image_removed event for every image which appeared
+// or disappeared between old and current.
+func (e *Engine) emitImageChanges(old, current []*Image) {
+	known := make(map[string]bool, len(old))
+	for _, image := range old {
+		known[image.Id] = true
+	}
+	present := make(map[string]bool, len(current))
+	for _, image := range current {
+		present[image.Id] = true
+		if !known[image.Id] {
+			e.emitImageEvent("image_added", image)
+		}
+	}
+	for _, image := range old {
+		if !present[image.Id] {
+			e.emitImageEvent("image_removed", image)
+		}
+	}
 }
 
-// Create a new container
-func (e *Engine) Create(config *dockerclient.ContainerConfig, name string, pullImage bool) (*Container, error) {
-	var (
-		err    error
-		id     string
-		client = e.client
-	)
+func (e *Engine) emitImageEvent(event string, image *Image) {
+	ev := e.newEvent(event)
+	ev.Id = image.Id
+	ev.RepoTags = image.RepoTags
+	e.dispatchEvent(ev)
+}
 
-	newConfig := *config
+// RefreshVolumes refreshes the list of volumes on the engine.
+func (e *Engine) RefreshVolumes() error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
 
-	// nb of CPUs -> real CpuShares
-	newConfig.CpuShares = config.CpuShares * 1024 / e.Cpus
+	volumes, err := client.ListVolumes()
+	if err != nil {
+		return err
+	}
+	unlock := e.observedLock("refresh_volumes")
+	e.volumes = nil
+	for _, volume := range volumes {
+		e.volumes = append(e.volumes, &Volume{Volume: *volume, Engine: e})
+	}
+	unlock()
+	return nil
+}
 
-	if id, err = client.CreateContainer(&newConfig, name); err != nil {
-		// If the error is other than not found, abort immediately.
-		if err != dockerclient.ErrNotFound || !pullImage {
-			return nil, err
+// RefreshNetworks refreshes the list of networks on the engine.
+func (e *Engine) RefreshNetworks() error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	networks, err := client.ListNetworks("")
+	if err != nil {
+		return err
+	}
+	unlock := e.observedLock("refresh_networks")
+	e.networks = nil
+	for _, network := range networks {
+		e.networks = append(e.networks, &Network{NetworkResource: *network, Engine: e})
+	}
+	unlock()
+	return nil
+}
+
+// Refresh the list and status of containers running on the engine. If `full` is
+// true, each container will be inspected.
+func (e *Engine) refreshContainers(full bool) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	var containers []dockerclient.Container
+	err = e.retry(func() (err error) {
+		containers, err = client.ListContainers(true, false, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Build the new state without holding the lock, it is only taken to
+	// publish the new state at once.
+	e.RLock()
+	current := make(map[string]*Container, len(e.containers))
+	for id, container := range e.containers {
+		current[id] = container
+	}
+	e.RUnlock()
+
+	// Inspects are slow, run the updates in parallel.
+	updated := make([]*Container, len(containers))
+	errs := make([]error, len(containers))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < e.inspectConcurrency() && w < len(containers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				c := containers[i]
+				updated[i], errs[i] = e.updateContainer(c, current[c.Id], full)
+			}
+		}()
+	}
+	for i := range containers {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	merged := make(map[string]*Container, len(containers))
+	for i, c := range containers {
+		container, err := updated[i], errs[i]
+		if err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to update state of container %q", c.Id)
+
+			// The container still exists, keep what we already know about it
+			// rather than dropping it from the state.
+			if known, exists := current[c.Id]; exists {
+				merged[c.Id] = known
+			}
+			continue
 		}
-		// Otherwise, try to pull the image...
-		if err = e.Pull(config.Image); err != nil {
-			return nil, err
+		merged[c.Id] = container
+	}
+
+	// Deferred first, so that it runs once the lock is released.
+	defer e.checkOvercommit()
+	unlock := e.observedLock("refresh_containers")
+	defer unlock()
+	e.containers = merged
+	e.volumeUsers = make(map[string]map[string]bool)
+	for _, container := range merged {
+		e.indexVolumes(nil, container)
+	}
+
+	// Forget about the restarts of containers that are gone.
+	for id := range e.restarts {
+		if _, exists := merged[id]; !exists {
+			delete(e.restarts, id)
 		}
-		// ...And try agaie.
-		if id, err = client.CreateContainer(&newConfig, name); err != nil {
+	}
+	// Events also refer to images, only forget about containers.
+	for id := range current {
+		if _, exists := merged[id]; !exists {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Infof("Evicting container %q, gone from the engine", id)
+			delete(e.lastEvents, id)
+		}
+	}
+
+	log.WithFields(log.Fields{"id": e.ID, "name": e.Name}).Debugf("Updated engine state")
+	return nil
+}
+
+// EvictStaleContainers removes from the state the containers gone from the
+// engine, e.g. removed while the engine was disconnected so that their
+// destroy event was missed. Refreshing the state does it too, this does not
+// inspect anything.
+func (e *Engine) EvictStaleContainers() error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	var containers []dockerclient.Container
+	err = e.retry(func() (err error) {
+		containers, err = client.ListContainers(true, false, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		present[c.Id] = true
+	}
+
+	unlock := e.observedLock("evict_containers")
+	defer unlock()
+	for id, container := range e.containers {
+		if present[id] {
+			continue
+		}
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Infof("Evicting container %q, gone from the engine", id)
+		e.indexVolumes(container, nil)
+		delete(e.containers, id)
+		delete(e.restarts, id)
+		delete(e.lastEvents, id)
+	}
+	return nil
+}
+
+// SetClientRetries sets how many times the idempotent calls refreshing the
+// engine state (listing and inspecting) are attempted before failing, the
+// first retry waiting for backoff and each next one twice as long as the
+// previous one. It must be set before the engine is connected.
+func (e *Engine) SetClientRetries(attempts int, backoff time.Duration) {
+	e.retries = attempts
+	e.retryBackoff = backoff
+}
+
+// Retry an idempotent client call, see SetClientRetries.
+func (e *Engine) retry(fn func() error) error {
+	return retry(e.retries, e.retryBackoff, fn)
+}
+
+// SetInspectConcurrency sets the number of containers inspected in parallel
+// when refreshing the state of the engine. It must be set before the engine
+// is connected.
+func (e *Engine) SetInspectConcurrency(n int) {
+	e.maxInspects = n
+}
+
+func (e *Engine) inspectConcurrency() int {
+	if e.maxInspects < 1 {
+		return 1
+	}
+	return e.maxInspects
+}
+
+// Refresh the status of a container running on the engine. If `full` is true,
+// the container will be inspected.
+func (e *Engine) refreshContainer(ID string, full bool) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	var containers []dockerclient.Container
+	err = e.retry(func() (err error) {
+		containers, err = client.ListContainers(true, false, fmt.Sprintf("{%q:[%q]}", "id", ID))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(containers) > 1 {
+		// We expect one container, if we get more than one, trigger a full refresh.
+		return e.refreshContainers(full)
+	}
+
+	if len(containers) == 0 {
+		// The container doesn't exist on the engine, remove it.
+		e.Lock()
+		e.indexVolumes(e.containers[ID], nil)
+		delete(e.containers, ID)
+		e.Unlock()
+
+		return nil
+	}
+
+	container, err := e.updateContainer(containers[0], e.ContainerByID(ID), full)
+	if err != nil {
+		return err
+	}
+
+	unlock := e.observedLock("update_container")
+	e.indexVolumes(e.containers[container.Id], container)
+	e.containers[container.Id] = container
+	unlock()
+
+	e.checkOvercommit()
+	return nil
+}
+
+// Build the new state of a container from its listing, `current` being its
+// last known state if any. Known containers are copied rather than modified
+// so that readers never see a container being updated.
+func (e *Engine) updateContainer(c dockerclient.Container, current *Container, full bool) (*Container, error) {
+	var container *Container
+
+	if current != nil {
+		// The container is already known.
+		updated := *current
+		container = &updated
+	} else {
+		// This is a brand new container. We need to do a full refresh.
+		container = &Container{
+			Engine: e,
+		}
+		full = true
+	}
+
+	// Update ContainerInfo. Concurrent full refreshes of the same container
+	// share a single inspect.
+	if full {
+		info, err := e.inspectContainer(c.Id)
+		if err != nil {
 			return nil, err
 		}
+		container.Info = e.containerInfo(info)
+	}
+	container.Container = c
+
+	return container, nil
+}
+
+// Convert the inspect result of a container to its cached form.
+func (e *Engine) containerInfo(info *dockerclient.ContainerInfo) dockerclient.ContainerInfo {
+	cached := *info
+	// The inspect result may be shared, work on a copy of the config.
+	if info.Config != nil {
+		config := *info.Config
+		cached.Config = &config
+		// real CpuShares -> nb of CPUs
+		if cpus := e.scalingCpus(&config); cpus > 0 {
+			cached.Config.CpuShares = cached.Config.CpuShares * 1024.0 / cpus
+		}
+	}
+	return cached
+}
+
+// Return the number of CPUs the CPU shares of a container are scaled by: the
+// one recorded at create, the current one of the engine otherwise.
+func (e *Engine) scalingCpus(config *dockerclient.ContainerConfig) int64 {
+	if config != nil {
+		if cpus, err := strconv.ParseInt(config.Labels[CpusLabel], 10, 64); err == nil && cpus > 0 {
+			return cpus
+		}
+	}
+	return e.Cpus
+}
+
+// Inspect a container, coalescing concurrent inspects of the same container
+// into a single call to the engine.
+func (e *Engine) inspectContainer(ID string) (*dockerclient.ContainerInfo, error) {
+	e.inspectsLock.Lock()
+	if call, exists := e.inspects[ID]; exists {
+		e.inspectsLock.Unlock()
+		call.wg.Wait()
+		return call.info, call.err
+	}
+	call := &inspectCall{}
+	call.wg.Add(1)
+	e.inspects[ID] = call
+	e.inspectsLock.Unlock()
+
+	client, err := e.clientOrErr()
+	if err == nil {
+		call.err = e.retry(func() (err error) {
+			call.info, err = client.InspectContainer(ID)
+			return err
+		})
+	} else {
+		call.err = err
+	}
+	call.wg.Done()
+
+	e.inspectsLock.Lock()
+	delete(e.inspects, ID)
+	e.inspectsLock.Unlock()
+
+	return call.info, call.err
+}
+
+func (e *Engine) refreshContainersAsync() {
+	e.ch <- true
+}
+
+// RefreshNow refreshes the state of the engine and waits for the refresh to
+// complete.
+func (e *Engine) RefreshNow() error {
+	if !e.isConnected() {
+		return ErrNotConnected
+	}
+	e.RLock()
+	done := e.refreshDone
+	e.RUnlock()
+
+	// The refresh loop may be gone already, stopped or the engine
+	// abandoned.
+	reply := make(chan error, 1)
+	select {
+	case e.refreshRequests <- reply:
+		return <-reply
+	case <-e.stop:
+	case <-done:
+	}
+	select {
+	case <-e.stop:
+		return ErrShutdown
+	default:
+		return ErrNotConnected
+	}
+}
+
+func (e *Engine) refreshLoop() {
+	for {
+		select {
+		case <-e.ch:
+			e.refresh()
+		case reply := <-e.refreshRequests:
+			reply <- e.refresh()
+		case <-e.clock.After(e.refreshPeriod()):
+			e.refresh()
+		case <-e.stop:
+			return
+		}
+
+		// The engine was abandoned.
+		if !e.isConnected() {
+			return
+		}
+		e.checkEventStream()
+	}
+}
+
+// SetPingPeriod pings the engine this often between the refreshes, keeping
+// its connection warm and flagging it as soon as it goes stale: a failed ping
+// triggers a refresh, which reconnects to the engine if it fails too. 0, the
+// default, disables the pings. It must be set before the engine is
+// connected.
+func (e *Engine) SetPingPeriod(period time.Duration) {
+	e.pingPeriod = period
+}
+
+func (e *Engine) pingLoop() {
+	for {
+		select {
+		case <-e.clock.After(e.pingPeriod):
+		case <-e.stop:
+			return
+		}
+
+		client, err := e.clientOrErr()
+		// The engine was abandoned.
+		if err != nil {
+			return
+		}
+		if err := client.Ping(); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Warnf("Ping failed, refreshing engine: %v", err)
+			select {
+			case e.ch <- true:
+			case <-e.stop:
+				return
+			}
+		}
+	}
+}
+
+// SetEventWatchdog pings the engine when no event was received for window.
+// An engine answering the ping is merely idle, otherwise the connection
+// carrying the event stream is stale and the monitoring is restarted on a
+// fresh client, replaying the events since the last one seen. The check runs
+// after each refresh. 0, the default, disables the watchdog. It must be set
+// before the engine is connected.
+func (e *Engine) SetEventWatchdog(window time.Duration) {
+	e.eventsWindow = window
+}
+
+// Restart the monitoring of events if the event stream looks stale.
+func (e *Engine) checkEventStream() {
+	if e.eventsWindow == 0 || !e.IsHealthy() {
+		return
+	}
+
+	e.RLock()
+	silence := e.clock.Now().Sub(e.eventsSeen)
+	e.RUnlock()
+	if silence < e.eventsWindow {
+		return
+	}
+
+	client, err := e.clientOrErr()
+	if err != nil {
+		return
+	}
+	if err := client.Ping(); err == nil {
+		e.Lock()
+		e.eventsSeen = e.clock.Now()
+		e.Unlock()
+		return
+	}
+
+	// Stopping the monitoring only lets the reader of the stream exit on its
+	// next event, restarting it on the same client would keep both running.
+	log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Warnf("No events received for %s and ping failed, restarting the event monitor", silence)
+	if err := e.reconnectClient(); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to reconnect to engine: %v", err)
+		return
+	}
+	e.startMonitorEvents()
+}
+
+// SetRefreshJitter sets the fraction of the refresh period by which each
+// refresh is randomly moved earlier or later. 0 disables the jitter.
+func (e *Engine) SetRefreshJitter(jitter float64) {
+	e.refreshJitter = jitter
+}
+
+// Return the time to wait until the next refresh.
+func (e *Engine) refreshPeriod() time.Duration {
+	jitter := e.refreshJitter * (2*rand.Float64() - 1)
+	return stateRefreshPeriod + time.Duration(jitter*float64(stateRefreshPeriod))
+}
+
+// SetMaxReconnectAttempts sets the number of consecutive failed refreshes
+// after which the engine is abandoned. 0 means never.
+func (e *Engine) SetMaxReconnectAttempts(n int) {
+	e.maxReconnectAttempts = n
+}
+
+// SetImageRefreshEnabled enables or disables refreshing the images with the
+// rest of the state, enabled by default. When disabled, the images are only
+// refreshed on connect and on image events.
+func (e *Engine) SetImageRefreshEnabled(enabled bool) {
+	e.imageRefreshDisabled = !enabled
+}
+
+// SetReconcileOnReconnect enables restarting, when the engine comes back to
+// life, the containers carrying a restart intent (see RestartLabel) that
+// died while the engine was disconnected. Disabled by default.
+func (e *Engine) SetReconcileOnReconnect(enabled bool) {
+	e.reconcileOnReconnect = enabled
+}
+
+// Refresh the state of the engine and keep track of its health.
+func (e *Engine) refresh() error {
+	if !e.IsHealthy() {
+		// The connection to a dead engine may be stale, start over with a
+		// fresh client.
+		if err := e.reconnectClient(); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to reconnect to engine: %v", err)
+			e.failedAttempt()
+			return err
+		}
+	}
+
+	err := e.refreshContainers(false)
+	if err == nil && !e.imageRefreshDisabled {
+		err = e.RefreshImages()
+	}
+	if err == nil {
+		// Older engines have no volumes nor networks, don't hold it against
+		// them.
+		if err := e.RefreshVolumes(); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Debugf("Unable to refresh volumes: %v", err)
+		}
+		if err := e.RefreshNetworks(); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Debugf("Unable to refresh networks: %v", err)
+		}
+	}
+
+	if err != nil {
+		if e.IsHealthy() {
+			e.Lock()
+			e.unhealthySince = e.clock.Now()
+			e.Unlock()
+			e.emitEvent("engine_disconnect")
+		}
+		e.setHealthy(false)
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Flagging engine as dead. Updated state failed: %v", err)
+		e.failedAttempt()
+	} else {
+		e.reconnectAttempts = 0
+		if !e.IsHealthy() {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Info("Engine came back to life. Hooray!")
+			e.startMonitorEvents()
+			e.emitEvent("engine_reconnect")
+			if err := e.updateSpecs(); err != nil {
+				log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Update engine specs failed: %v", err)
+			}
+			if e.reconcileOnReconnect {
+				e.reconcileContainers()
+			}
+		}
+		e.setHealthy(true)
+		e.Lock()
+		e.lastUpdate = e.clock.Now()
+		e.unhealthySince = time.Time{}
+		e.Unlock()
+	}
+	return err
+}
+
+// Monitor the events of the engine, resuming from the last event seen so
+// that the events of the disconnection window are not missed.
+func (e *Engine) startMonitorEvents() {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return
+	}
+
+	e.Lock()
+	since := e.lastEventTime
+	e.eventsSeen = e.clock.Now()
+	e.Unlock()
+
+	if since == 0 {
+		client.StartMonitorEvents(e.handler, nil)
+		return
+	}
+	client.StartMonitorEventsSince(since, e.handler, nil)
+}
+
+// Restart the containers with a restart intent which are found stopped.
+func (e *Engine) reconcileContainers() {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return
+	}
+
+	for _, container := range e.Containers() {
+		if !container.restartIntent() {
+			continue
+		}
+
+		// The state may date from before the disconnection.
+		if err := e.refreshContainer(container.Id, true); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to update state of container %q: %v", container.Id, err)
+			continue
+		}
+		if container = e.ContainerByID(container.Id); container == nil || container.State() != StateExited {
+			continue
+		}
+
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Infof("Restarting container %q", container.Id)
+		if err := client.StartContainer(container.Id, nil); err != nil {
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to restart container %q: %v", container.Id, err)
+			continue
+		}
+		e.refreshContainer(container.Id, true)
+	}
+}
+
+// Make sure the engine client talks to is still the one originally
+// connected to, its address may have been reused by another host.
+func (e *Engine) checkIdentity(client dockerclient.Client) error {
+	// Never connected, nothing to compare against.
+	if e.ID == "" {
+		return nil
+	}
+
+	info, err := client.Info()
+	if err != nil {
+		return err
+	}
+	if info.ID != e.ID {
+		e.emitEvent("engine_mismatch")
+		return fmt.Errorf("engine %s changed identity from %s to %s", e.Addr, e.ID, info.ID)
+	}
+	return nil
+}
+
+// Track an operation on the engine so that Shutdown waits for it. The
+// returned function must be called once the operation is done.
+func (e *Engine) startOperation() (func(), error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.shutdown {
+		return nil, ErrShutdown
+	}
+	e.operations.Add(1)
+	return e.operations.Done, nil
+}
+
+// Shutdown stops the refresh loop, refuses new operations and waits up to
+// timeout for the creations, removals and pulls in flight to complete before
+// disconnecting the engine.
+func (e *Engine) Shutdown(timeout time.Duration) error {
+	e.Lock()
+	if !e.shutdown {
+		e.shutdown = true
+		close(e.stop)
+	}
+	e.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.operations.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return fmt.Errorf("engine %s still has operations in flight after %s", e.Addr, timeout)
+	}
+
+	if client := e.replaceClient(nil); client != nil {
+		client.StopAllMonitorEvents()
+	}
+	return nil
+}
+
+// Count a failed refresh, abandoning the engine once there are too many.
+func (e *Engine) failedAttempt() {
+	e.reconnectAttempts++
+	if e.maxReconnectAttempts == 0 || e.reconnectAttempts < e.maxReconnectAttempts {
+		return
+	}
+
+	log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Giving up on engine after %d failed attempts", e.reconnectAttempts)
+	if client := e.replaceClient(nil); client != nil {
+		client.StopAllMonitorEvents()
+	}
+	e.emitEvent("engine_removed")
+}
+
+// Replace the client of the engine with a brand new one, unless the address
+// now leads to another engine: the new client is then dropped, and the
+// previous one kept.
+func (e *Engine) reconnectClient() error {
+	c, err := newClient(e.Addr, e.tlsConfig)
+	if err != nil {
+		return err
+	}
+	client := e.limitClient(c)
+	if err := e.checkIdentity(client); err != nil {
+		return err
+	}
+	if previous := e.replaceClient(client); previous != nil {
+		previous.StopAllMonitorEvents()
+	}
+	return nil
+}
+
+// SetRateLimit limits the calls to the engine to rps per second, calls
+// beyond the limit block until they are allowed. 0 means unlimited. It must
+// be set before the engine is connected.
+func (e *Engine) SetRateLimit(rps int) {
+	e.limiter = nil
+	if rps > 0 {
+		e.limiter = newRateLimiter(rps)
+	}
+}
+
+// Wrap client so that its calls go through the rate limiter, if any.
+func (e *Engine) limitClient(client dockerclient.Client) dockerclient.Client {
+	if e.limiter == nil {
+		return client
+	}
+	return &limitedClient{Client: client, limiter: e.limiter, stop: e.stop}
+}
+
+func (e *Engine) emitEvent(event string) {
+	e.dispatchEvent(e.newEvent(event))
+}
+
+// Build a synthetic swarm event for this engine.
+func (e *Engine) newEvent(event string) *Event {
+	return &Event{
+		Event: dockerclient.Event{
+			Status: event,
+			From:   "swarm",
+			Time:   e.clock.Now().Unix(),
+		},
+		Engine: e,
+		Node:   e.eventNode(),
+	}
+}
+
+// Snapshot the identity of the engine for the events it emits.
+func (e *Engine) eventNode() EventNode {
+	node := EventNode{
+		ID:   e.ID,
+		Name: e.Name,
+		IP:   e.IP,
+		Addr: e.Addr,
+	}
+	e.RLock()
+	if len(e.Labels) > 0 {
+		node.Labels = e.copyLabels()
+	}
+	e.RUnlock()
+	return node
+}
+
+func (e *Engine) dispatchEvent(ev *Event) {
+	e.eventsLock.RLock()
+	handler, filter := e.eventHandler, e.eventFilter
+	// Subscribers are never waited for, a slow one only misses events.
+	for ch := range e.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Warnf("Dropping %q event, subscriber is too slow", ev.Status)
+		}
+	}
+	e.eventsLock.RUnlock()
+
+	// If there is no event handler registered, abort right now.
+	if handler == nil {
+		return
+	}
+	if filter != nil && !filter[ev.Status] {
+		return
+	}
+	handler.Handle(ev)
+}
+
+// UsedMemory returns the sum of memory reserved by containers, and through
+// Reserve.
+func (e *Engine) UsedMemory() int64 {
+	e.RLock()
+	_, memory := e.used()
+	e.RUnlock()
+	return memory
+}
+
+// UsedCpus returns the sum of CPUs reserved by containers, and through
+// Reserve.
+func (e *Engine) UsedCpus() int64 {
+	e.RLock()
+	cpus, _ := e.used()
+	e.RUnlock()
+	return cpus
+}
+
+// Return the CPUs and memory reserved by containers and through Reserve.
+// Called with the lock held.
+func (e *Engine) used() (cpus, memory int64) {
+	cpus, memory = e.pendingCpus, e.pendingMemory
+	for _, c := range e.containers {
+		if e.reserves(c) {
+			cpus += c.ReservedCpus()
+			memory += c.ReservedMemory()
+		}
+	}
+	return cpus, memory
+}
+
+// Reserve accounts the CPUs and memory of a container about to be created
+// as used, so that concurrent schedulers don't place containers on resources
+// already promised. It fails if they would exceed the total + overcommit of
+// the engine. The reservation must be released once the container is
+// created, its own reservation then takes over, or if it is never created.
+func (e *Engine) Reserve(cpus, memory int64) (release func(), ok bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	usedCpus, usedMemory := e.used()
+	if usedCpus+cpus > e.TotalCpus() || usedMemory+memory > e.TotalMemory() {
+		return nil, false
+	}
+	e.pendingCpus += cpus
+	e.pendingMemory += memory
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.Lock()
+			e.pendingCpus -= cpus
+			e.pendingMemory -= memory
+			e.Unlock()
+		})
+	}, true
+}
+
+// SetReserveStopped makes the stopped containers count towards the memory,
+// CPUs and GPUs used on the engine, as if they could be started at any time.
+// By default, only the created (about to be started), running, paused and
+// restarting containers do.
+func (e *Engine) SetReserveStopped(enabled bool) {
+	e.Lock()
+	e.reserveStopped = enabled
+	e.Unlock()
+}
+
+// Return true if the resources of container are accounted for. Called with
+// the lock held.
+func (e *Engine) reserves(container *Container) bool {
+	return e.reserveStopped || container.State() != StateExited
+}
+
+// TotalMemory returns the total memory + overcommit
+func (e *Engine) TotalMemory() int64 {
+	return e.Memory + (e.Memory * e.overcommitRatio / 100)
+}
+
+// TotalCpus returns the total cpus + overcommit
+func (e *Engine) TotalCpus() int64 {
+	return e.Cpus + (e.Cpus * e.overcommitRatio / 100)
+}
+
+// UsedMemorySwap returns the sum of memory + swap reserved by containers, see
+// Container.ReservedMemorySwap.
+func (e *Engine) UsedMemorySwap() int64 {
+	var r int64
+	e.RLock()
+	for _, c := range e.containers {
+		if e.reserves(c) {
+			r += c.ReservedMemorySwap()
+		}
+	}
+	e.RUnlock()
+	return r
+}
+
+// TotalMemorySwap returns the total memory + overcommit, plus the swap of
+// the engine advertised in bytes through its "swap" label. It is 0 when the
+// engine doesn't support swap limits.
+func (e *Engine) TotalMemorySwap() int64 {
+	e.RLock()
+	supported := e.info != nil && e.info.SwapLimit
+	value := e.Labels["swap"]
+	e.RUnlock()
+
+	if !supported {
+		return 0
+	}
+	swap, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || swap < 0 {
+		swap = 0
+	}
+	return e.TotalMemory() + swap
+}
+
+// TotalGpus returns the number of GPUs of the engine, advertised through its
+// "gpus" label.
+func (e *Engine) TotalGpus() int64 {
+	e.RLock()
+	value := e.Labels["gpus"]
+	e.RUnlock()
+
+	gpus, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || gpus < 0 {
+		return 0
+	}
+	return gpus
+}
+
+// UsedGpus returns the number of GPUs requested by containers, counting the
+// same containers as UsedMemory and UsedCpus.
+func (e *Engine) UsedGpus() int64 {
+	total := e.TotalGpus()
+
+	var r int64
+	e.RLock()
+	for _, c := range e.containers {
+		if c.Info.HostConfig != nil && e.reserves(c) {
+			r += requestedGpus(c.Info.HostConfig.DeviceRequests, total)
+		}
+	}
+	e.RUnlock()
+	return r
+}
+
+// Count the GPUs of device requests, a count of -1 requesting all of them.
+func requestedGpus(requests []dockerclient.DeviceRequest, total int64) int64 {
+	var gpus int64
+	for _, request := range requests {
+		if !isGpuRequest(request) {
+			continue
+		}
+		switch {
+		case request.Count < 0:
+			gpus += total
+		case request.Count > 0:
+			gpus += int64(request.Count)
+		default:
+			gpus += int64(len(request.DeviceIDs))
+		}
+	}
+	return gpus
+}
+
+func isGpuRequest(request dockerclient.DeviceRequest) bool {
+	for _, capabilities := range request.Capabilities {
+		for _, capability := range capabilities {
+			if capability == "gpu" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EngineCapacity is a snapshot of the reservations and totals of an engine.
+type EngineCapacity struct {
+	TotalCpus      int64
+	UsedCpus       int64
+	TotalMemory    int64
+	UsedMemory     int64
+	ContainerCount int64
+}
+
+// Capacity returns the reservations and totals of the engine, all computed
+// from the same state.
+func (e *Engine) Capacity() EngineCapacity {
+	e.RLock()
+	defer e.RUnlock()
+
+	capacity := EngineCapacity{
+		TotalCpus:      e.TotalCpus(),
+		TotalMemory:    e.TotalMemory(),
+		ContainerCount: int64(len(e.containers)),
+	}
+	capacity.UsedCpus, capacity.UsedMemory = e.used()
+	return capacity
+}
+
+// MemoryUtilization returns the ratio of reserved memory to the total memory
+// + overcommit. It is greater than 1 when the engine is overcommitted.
+func (e *Engine) MemoryUtilization() float64 {
+	capacity := e.Capacity()
+	return utilization(capacity.UsedMemory, capacity.TotalMemory)
+}
+
+// CpuUtilization returns the ratio of reserved CPUs to the total cpus
+// + overcommit. It is greater than 1 when the engine is overcommitted.
+func (e *Engine) CpuUtilization() float64 {
+	capacity := e.Capacity()
+	return utilization(capacity.UsedCpus, capacity.TotalCpus)
+}
+
+// IsOvercommitted returns whether the memory and the CPUs reserved by the
+// containers exceed the total + overcommit of the engine.
+func (e *Engine) IsOvercommitted() (memOver, cpuOver bool) {
+	capacity := e.Capacity()
+	return overcommitted(capacity.UsedMemory, capacity.TotalMemory), overcommitted(capacity.UsedCpus, capacity.TotalCpus)
+}
+
+// Unknown totals are never exceeded.
+func overcommitted(used, total int64) bool {
+	return total > 0 && used > total
+}
+
+// Emit an engine_overcommitted event when the engine becomes overcommitted.
+func (e *Engine) checkOvercommit() {
+	memOver, cpuOver := e.IsOvercommitted()
+	over := memOver || cpuOver
+
+	e.Lock()
+	crossed := over && !e.overcommitted
+	e.overcommitted = over
+	e.Unlock()
+
+	if crossed {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Warnf("Engine is overcommitted (memory: %t, cpus: %t)", memOver, cpuOver)
+		e.emitEvent("engine_overcommitted")
+	}
+}
+
+// Placement strategies of Score.
+const (
+	BinpackStrategy = "binpack"
+	SpreadStrategy  = "spread"
+)
+
+// Score returns how well a container with config fits on the engine, the
+// higher the better, or ErrNoFit if it doesn't fit at all. The score goes
+// from 0 to 200, the CPU and memory utilizations of the engine once the
+// container is placed, in percents, added together: engines end up the
+// fullest with the "binpack" strategy, the emptiest with "spread" which
+// scores the free resources instead.
+func (e *Engine) Score(config *dockerclient.ContainerConfig, strategy string) (float64, error) {
+	if strategy != BinpackStrategy && strategy != SpreadStrategy {
+		return 0, fmt.Errorf("unknown placement strategy %q", strategy)
+	}
+
+	capacity := e.Capacity()
+	cpus := capacity.UsedCpus + reservation(config, CpuReservationLabel, config.CpuShares)
+	memory := capacity.UsedMemory + reservation(config, MemoryReservationLabel, config.Memory)
+	if cpus > capacity.TotalCpus || memory > capacity.TotalMemory {
+		return 0, ErrNoFit
+	}
+
+	score := 100 * (utilization(cpus, capacity.TotalCpus) + utilization(memory, capacity.TotalMemory))
+	if strategy == SpreadStrategy {
+		score = 200 - score
+	}
+	return score, nil
+}
+
+func utilization(used, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total)
+}
+
+// Create a new container
+func (e *Engine) Create(config *dockerclient.ContainerConfig, name string, pullImage bool) (*Container, error) {
+	return e.CreateWithProgress(config, name, pullImage, nil)
+}
+
+// CreateWithProgress creates a new container like Create, reporting the
+// phases of the pull of its image when it is missing. `callback` is called
+// with the image and the status: "pulling", then "downloaded" or "failed",
+// then "creating" when the create is attempted again. The client doesn't
+// stream the progress of the pull itself, only these phases are reported.
+func (e *Engine) CreateWithProgress(config *dockerclient.ContainerConfig, name string, pullImage bool, callback func(what, status string)) (*Container, error) {
+	done, err := e.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	id, err := e.createContainer(config, name, pullImage, callback)
+	if err != nil {
+		return nil, err
+	}
+
+	// Register the container immediately while waiting for a state refresh.
+	// Force a state refresh to pick up the newly created container.
+	e.refreshContainer(id, true)
+
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.containers[id], nil
+}
+
+// Return the ID of the container created with the idempotency key of config,
+// if any. The daemon is asked, the state misses the containers whose create
+// failed on the way back.
+func (e *Engine) idempotentContainer(client dockerclient.Client, config *dockerclient.ContainerConfig) (string, error) {
+	key := config.Labels[IdempotencyKeyLabel]
+	if key == "" {
+		return "", nil
+	}
+
+	filters := fmt.Sprintf("{%q:[%q]}", "label", IdempotencyKeyLabel+"="+key)
+	var containers []dockerclient.Container
+	err := e.retry(func() (err error) {
+		containers, err = client.ListContainers(true, false, filters)
+		return err
+	})
+	if err != nil || len(containers) == 0 {
+		return "", err
+	}
+	return containers[0].Id, nil
+}
+
+// CreateHook is called with the requested configuration before a container
+// is created, a non-nil error aborts the creation.
+type CreateHook func(config *dockerclient.ContainerConfig) error
+
+// SetCreateHook registers a hook run before every container creation, e.g.
+// to enforce policies. It must be set before the engine is connected.
+func (e *Engine) SetCreateHook(hook CreateHook) {
+	e.createHook = hook
+}
+
+// CreateBatch creates several containers, refreshing the engine state only
+// once they are all created. Results and errors are returned per index.
+func (e *Engine) CreateBatch(configs []*dockerclient.ContainerConfig, names []string, pullImage bool) ([]*Container, []error) {
+	containers := make([]*Container, len(configs))
+	errs := make([]error, len(configs))
+
+	if len(names) != len(configs) {
+		for i := range errs {
+			errs[i] = fmt.Errorf("got %d names for %d containers", len(names), len(configs))
+		}
+		return containers, errs
+	}
+
+	done, err := e.startOperation()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return containers, errs
+	}
+	defer done()
+
+	ids := make([]string, len(configs))
+	created := 0
+	for i, config := range configs {
+		// The new containers are only known after the refresh, count them
+		// against the limit in the meantime.
+		if errs[i] = e.checkContainerLimit(created); errs[i] != nil {
+			continue
+		}
+		if ids[i], errs[i] = e.createContainer(config, names[i], pullImage, nil); errs[i] == nil {
+			created++
+		}
+	}
+
+	// Pick up all the new containers at once.
+	if err := e.refreshContainers(false); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh containers after batch create: %v", err)
+	}
+
+	for i, id := range ids {
+		if errs[i] == nil {
+			containers[i] = e.ContainerByID(id)
+		}
+	}
+	return containers, errs
+}
+
+// Create a container on the engine and return its ID.
+func (e *Engine) createContainer(config *dockerclient.ContainerConfig, name string, pullImage bool, callback func(what, status string)) (string, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return "", err
+	}
+
+	// The retry of a create which went through gets the container created.
+	if id, err := e.idempotentContainer(client, config); err != nil || id != "" {
+		return id, err
+	}
+
+	if e.IsCordoned() {
+		return "", ErrCordoned
+	}
+
+	if err := e.checkContainerLimit(0); err != nil {
+		return "", err
+	}
+
+	if name != "" && e.ContainerByName(name) != nil {
+		return "", ErrNameConflict
+	}
+
+	if e.createHook != nil {
+		if err := e.createHook(config); err != nil {
+			return "", err
+		}
+	}
+
+	if err := e.checkConfig(config); err != nil {
+		return "", err
+	}
+
+	// The host config travels with the config so that bindings, restart
+	// policies and mounts are set at create time rather than at start.
+	newConfig := *config
+
+	// nb of CPUs -> real CpuShares
+	newConfig.CpuShares = config.CpuShares * 1024 / e.Cpus
+
+	// Tag the container as scheduled by swarm.
+	newConfig.Labels = make(map[string]string, len(config.Labels)+2)
+	for k, v := range config.Labels {
+		newConfig.Labels[k] = v
+	}
+	if _, ok := newConfig.Labels[SwarmIDLabel]; !ok {
+		newConfig.Labels[SwarmIDLabel] = generateID()
+	}
+	// Keep the scaling of the shares even if the number of CPUs changes.
+	newConfig.Labels[CpusLabel] = strconv.FormatInt(e.Cpus, 10)
+
+	var id string
+	if id, err = client.CreateContainer(&newConfig, name); err != nil {
+		// If the error is other than not found, abort immediately.
+		if err != dockerclient.ErrNotFound || !pullImage {
+			return "", err
+		}
+		// Otherwise, try to pull the image...
+		progress := func(status string) {
+			if callback != nil {
+				callback(config.Image, status)
+			}
+		}
+		progress("pulling")
+		if err = e.Pull(config.Image); err != nil {
+			progress("failed")
+			return "", err
+		}
+		progress("downloaded")
+		// ...And try again.
+		progress("creating")
+		if id, err = client.CreateContainer(&newConfig, name); err != nil {
+			return "", err
+		}
+	}
+
+	return id, nil
+}
+
+// SetMaxContainers sets the number of containers, running or not, past which
+// the engine refuses to create new ones. 0 means unlimited.
+func (e *Engine) SetMaxContainers(n int) {
+	e.Lock()
+	e.maxContainers = n
+	e.Unlock()
+}
+
+// Make sure the engine has room for one more container, on top of `pending`
+// containers being created.
+func (e *Engine) checkContainerLimit(pending int) error {
+	e.RLock()
+	max, count := e.maxContainers, len(e.containers)+pending
+	e.RUnlock()
+
+	if max > 0 && count >= max {
+		return fmt.Errorf("cannot create container on %s: limit of %d containers reached", e.Addr, max)
+	}
+	return nil
+}
+
+// Make sure a container configuration can be created on the engine.
+func (e *Engine) checkConfig(config *dockerclient.ContainerConfig) error {
+	// The CPU count is needed to scale CpuShares, refuse to go further
+	// without it.
+	if e.Cpus == 0 {
+		return fmt.Errorf("cannot create container on %s: number of CPUs is unknown", e.Addr)
+	}
+
+	// Cpusets are passed through as is, make sure they exist on the engine.
+	for _, cpuset := range []string{config.Cpuset, config.CpusetCpus} {
+		if err := checkCpuset(cpuset, e.Cpus); err != nil {
+			return fmt.Errorf("cannot create container on %s: %v", e.Addr, err)
+		}
+	}
+	if err := checkCpuset(config.CpusetMems, -1); err != nil {
+		return fmt.Errorf("cannot create container on %s: %v", e.Addr, err)
+	}
+
+	// So is the runtime. Engines reporting no runtimes are left to decide.
+	if runtime := config.HostConfig.Runtime; runtime != "" && e.reportsRuntimes() && !e.HasRuntime(runtime) {
+		return fmt.Errorf("cannot create container on %s: unknown runtime %q", e.Addr, runtime)
+	}
+
+	for _, label := range []string{MemoryReservationLabel, CpuReservationLabel} {
+		if value, exists := config.Labels[label]; exists {
+			if _, err := parseReservation(value); err != nil {
+				return fmt.Errorf("cannot create container on %s: %v", e.Addr, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CanCreate returns why a container could not be created on the engine, or
+// nil if it could: the engine must accept containers, the name must be free,
+// the resources must be available and the image must be on the engine,
+// unless pullImage is set as for Create. Nothing is created.
+func (e *Engine) CanCreate(config *dockerclient.ContainerConfig, name string, pullImage bool) error {
+	if e.IsCordoned() {
+		return ErrCordoned
+	}
+
+	if err := e.checkContainerLimit(0); err != nil {
+		return err
+	}
+
+	if name != "" && e.ContainerByName(name) != nil {
+		return ErrNameConflict
+	}
+
+	if err := e.checkConfig(config); err != nil {
+		return err
+	}
+
+	capacity := e.Capacity()
+	if memory := reservation(config, MemoryReservationLabel, config.Memory); capacity.UsedMemory+memory > capacity.TotalMemory {
+		return fmt.Errorf("cannot create container on %s: not enough memory", e.Addr)
+	}
+	if cpus := reservation(config, CpuReservationLabel, config.CpuShares); capacity.UsedCpus+cpus > capacity.TotalCpus {
+		return fmt.Errorf("cannot create container on %s: not enough CPUs", e.Addr)
+	}
+
+	if !pullImage && !e.HasImage(config.Image) {
+		return ErrImageNotFound
+	}
+	return nil
+}
+
+// checkCpuset validates a cpuset list (e.g. "0-3,6") and makes sure every
+// entry is lower than max. A negative max only validates the syntax.
+func checkCpuset(cpuset string, max int64) error {
+	if cpuset == "" {
+		return nil
+	}
+	for _, part := range strings.Split(cpuset, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cpuset %q", cpuset)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || high < low {
+				return fmt.Errorf("invalid cpuset %q", cpuset)
+			}
+		}
+		if low < 0 || (max >= 0 && high >= max) {
+			return fmt.Errorf("cpuset %q is out of range, %d CPUs available", cpuset, max)
+		}
+	}
+	return nil
+}
+
+// Destroy and remove a container from the engine.
+func (e *Engine) Destroy(container *Container, force, removeVolumes bool) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	done, err := e.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err := client.RemoveContainer(container.Id, force, removeVolumes); err != nil {
+		return err
+	}
+
+	// Remove the container from the state. Eventually, the state refresh loop
+	// will rewrite this.
+	e.Lock()
+	defer e.Unlock()
+	e.indexVolumes(e.containers[container.Id], nil)
+	delete(e.containers, container.Id)
+
+	return nil
+}
+
+// DestroyBatch removes several containers from the engine, refreshing the
+// engine state only once they are all removed. Errors are returned per index.
+func (e *Engine) DestroyBatch(containers []*Container, force, removeVolumes bool) []error {
+	errs := make([]error, len(containers))
+
+	client, err := e.clientOrErr()
+	var done func()
+	if err == nil {
+		done, err = e.startOperation()
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer done()
+
+	for i, container := range containers {
+		errs[i] = client.RemoveContainer(container.Id, force, removeVolumes)
+	}
+
+	// Drop all the removed containers at once.
+	if err := e.refreshContainers(false); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh containers after batch destroy: %v", err)
+	}
+	return errs
+}
+
+// UpdateResources changes the memory and CPU limits of a container.
+func (e *Engine) UpdateResources(container *Container, memory, cpuShares int64) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return err
+	}
+	cpus := e.scalingCpus(container.Info.Config)
+	if cpus == 0 {
+		return fmt.Errorf("cannot update container on %s: number of CPUs is unknown", e.Addr)
+	}
+
+	config := &dockerclient.UpdateConfig{
+		Memory: memory,
+		// nb of CPUs -> real CpuShares
+		CpuShares: cpuShares * 1024 / cpus,
+	}
+	resize := &ResourceChange{}
+	if container.Info.Config != nil {
+		resize.OldMemory = container.Info.Config.Memory
+		resize.OldCpus = container.Info.Config.CpuShares
+	}
+
+	if err := client.UpdateContainer(container.Id, config); err != nil {
+		return err
+	}
+
+	// Refresh the container so that the new reservation is accounted for.
+	if err := e.refreshContainer(container.Id, true); err != nil {
+		return err
+	}
+
+	if updated := e.ContainerByID(container.Id); updated != nil && updated.Info.Config != nil {
+		resize.NewMemory = updated.Info.Config.Memory
+		resize.NewCpus = updated.Info.Config.CpuShares
+	}
+
+	// Let handlers adjust their view of the engine capacity right away.
+	ev := e.newEvent("container_resize")
+	ev.Id = container.Id
+	ev.Resize = resize
+	e.dispatchEvent(ev)
+
+	return nil
+}
+
+// InspectContainer inspects a container on the engine, updates its cached
+// state and returns it.
+func (e *Engine) InspectContainer(container *Container) (*dockerclient.ContainerInfo, error) {
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	info, err := e.inspectContainer(container.Id)
+	if err != nil {
+		return nil, err
+	}
+	cached := e.containerInfo(info)
+
+	e.Lock()
+	if current, exists := e.containers[container.Id]; exists {
+		updated := *current
+		updated.Info = cached
+		e.indexVolumes(current, &updated)
+		e.containers[container.Id] = &updated
+	}
+	e.Unlock()
+
+	return &cached, nil
+}
+
+// Wait blocks until a container exits and returns its exit code.
+func (e *Engine) Wait(container *Container) (int, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return -1, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return -1, err
+	}
+
+	code, err := client.WaitContainer(container.Id)
+	if err != nil {
+		return -1, err
+	}
+
+	// Cache the final state of the container.
+	e.refreshContainer(container.Id, true)
+
+	return code, nil
+}
+
+// Top lists the processes running in a container. psArgs are passed to ps,
+// the daemon default is used when empty.
+func (e *Engine) Top(container *Container, psArgs string) (*dockerclient.ContainerProcessList, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	return client.TopContainer(container.Id, psArgs)
+}
+
+// Logs returns the logs of a container, selected by options: stdout and/or
+// stderr, the last Tail lines, only the lines since the Since unix
+// timestamp, with timestamps or not. With Follow, the logs are streamed
+// until the reader is closed. Unless the container has a TTY, stdout and
+// stderr are multiplexed in the stream as frames, each starting with an
+// 8-byte header: the stream (1 for stdout, 2 for stderr) then 3 zero bytes
+// then the big-endian uint32 size of the frame.
+func (e *Engine) Logs(container *Container, options *dockerclient.LogOptions) (io.ReadCloser, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	return client.ContainerLogs(container.Id, options)
+}
+
+// CopyToContainer extracts the tar archive content into the directory path
+// of a container.
+func (e *Engine) CopyToContainer(container *Container, path string, content io.Reader) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return err
+	}
+
+	return client.PutArchive(container.Id, path, content)
+}
+
+// CopyFromContainer returns a tar archive of the file or directory path of a
+// container. The caller must close it.
+func (e *Engine) CopyFromContainer(container *Container, path string) (io.ReadCloser, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	return client.GetArchive(container.Id, path)
+}
+
+// Commit snapshots a container into a new image.
+func (e *Engine) Commit(container *Container, repo, tag string, config *dockerclient.ContainerConfig) (*Image, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	id, err := client.CommitContainer(container.Id, repo, tag, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick up the new image.
+	if err := e.RefreshImages(); err != nil {
+		return nil, err
+	}
+
+	image := e.Image(id)
+	if image == nil {
+		return nil, fmt.Errorf("image %s not found on %s after commit", id, e)
+	}
+	return image, nil
+}
+
+// Stats streams the resource usage of a container, invoking `cb` for each
+// sample until the returned stop function is called or the stream ends.
+func (e *Engine) Stats(container *Container, cb func(*dockerclient.Stats)) (func(), error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return nil, err
+	}
+
+	stream, err := client.ContainerStats(container.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the stream ends the request, and the reader with it.
+	var (
+		stopped int32
+		once    sync.Once
+	)
+	stop := func() {
+		once.Do(func() {
+			atomic.StoreInt32(&stopped, 1)
+			stream.Close()
+		})
+	}
+
+	go func() {
+		defer stop()
+		dec := json.NewDecoder(stream)
+		for {
+			var stats *dockerclient.Stats
+			if err := dec.Decode(&stats); err != nil {
+				return
+			}
+			if atomic.LoadInt32(&stopped) == 0 {
+				cb(stats)
+			}
+		}
+	}()
+	return stop, nil
+}
+
+// DrainContainers gracefully stops every running container of the engine,
+// waiting `timeout` seconds for each of them before killing it. Failures
+// don't abort the drain and are returned per container.
+func (e *Engine) DrainContainers(timeout int) []error {
+	client, err := e.clientOrErr()
+	var done func()
+	if err == nil {
+		done, err = e.startOperation()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	defer done()
+
+	var errs []error
+	for _, container := range e.Containers() {
+		if !container.Info.State.Running {
+			continue
+		}
+		if err := client.StopContainer(container.Id, timeout); err != nil {
+			errs = append(errs, fmt.Errorf("unable to stop container %s: %v", container.Id, err))
+			continue
+		}
+		// Pick up the stopped state of the container.
+		if err := e.refreshContainer(container.Id, true); err != nil {
+			errs = append(errs, fmt.Errorf("unable to refresh container %s: %v", container.Id, err))
+		}
+	}
+	return errs
+}
+
+// StopAndRemoveByLabel tears down the containers of the engine whose label
+// key is value: each of them is stopped, waiting `stopTimeout` seconds before
+// killing it, then removed. With force, the containers which failed to stop
+// are removed anyway. The engine state is refreshed once they are all gone.
+// Failures don't abort the teardown and are returned per container.
+func (e *Engine) StopAndRemoveByLabel(key, value string, stopTimeout int, force bool) []error {
+	client, err := e.clientOrErr()
+	var done func()
+	if err == nil {
+		done, err = e.startOperation()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	defer done()
+
+	var errs []error
+	for _, container := range e.ContainersByLabelSelector(map[string]string{key: value}) {
+		if container.Info.State.Running {
+			if err := client.StopContainer(container.Id, stopTimeout); err != nil {
+				errs = append(errs, fmt.Errorf("unable to stop container %s: %v", container.Id, err))
+				if !force {
+					continue
+				}
+			}
+		}
+		if err := client.RemoveContainer(container.Id, force, false); err != nil {
+			errs = append(errs, fmt.Errorf("unable to remove container %s: %v", container.Id, err))
+		}
+	}
+
+	// Drop all the removed containers at once.
+	if err := e.refreshContainers(false); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh containers after teardown: %v", err)
+	}
+	return errs
+}
+
+// Pull an image on the engine. Concurrent pulls of the same image wait for
+// the first one rather than pulling again.
+func (e *Engine) Pull(image string) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+
+	done, err := e.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	pulled, err := e.pull(client, image, nil)
+	if pulled {
+		// force refresh images
+		e.RefreshImages()
+	}
+	return err
+}
+
+// PullImages pulls several images on the engine, e.g. to pre-warm it before
+// a deployment, refreshing the engine images only once they are all pulled.
+// The images are pulled with auth, or the credentials of the credential
+// provider if nil. Errors are returned per index.
+func (e *Engine) PullImages(images []string, auth *dockerclient.AuthConfig) []error {
+	errs := make([]error, len(images))
+
+	client, err := e.clientOrErr()
+	var done func()
+	if err == nil {
+		done, err = e.startOperation()
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer done()
+
+	for i, image := range images {
+		_, errs[i] = e.pull(client, image, auth)
+	}
+
+	if err := e.RefreshImages(); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh images after batch pull: %v", err)
+	}
+	return errs
+}
+
+// Pull an image, with auth or the credentials of the credential provider if
+// nil. Concurrent pulls of the same image share a single pull, only the call
+// which pulled the image successfully returns true.
+func (e *Engine) pull(client dockerclient.Client, image string, auth *dockerclient.AuthConfig) (bool, error) {
+	image = e.pullName(image)
+
+	e.pullsLock.Lock()
+	if call, exists := e.pulls[image]; exists {
+		e.pullsLock.Unlock()
+		call.wg.Wait()
+		return false, call.err
+	}
+	call := &pullCall{}
+	call.wg.Add(1)
+	e.pulls[image] = call
+	e.pullsLock.Unlock()
+
+	if auth == nil && e.credentials != nil {
+		auth, call.err = e.credentials(imageRegistry(image))
+	}
+	if call.err == nil {
+		call.err = client.PullImage(image, auth)
+	}
+
+	e.pullsLock.Lock()
+	delete(e.pulls, image)
+	e.pullsLock.Unlock()
+	call.wg.Done()
+
+	return call.err == nil, call.err
+}
+
+// CredentialProvider returns the credentials to pull images from registry,
+// nil meaning anonymous pulls.
+type CredentialProvider func(registry string) (*dockerclient.AuthConfig, error)
+
+// SetCredentialProvider registers the provider consulted for the credentials
+// of every pull, including the pulls done by Create. It must be set before
+// the engine is connected.
+func (e *Engine) SetCredentialProvider(provider CredentialProvider) {
+	e.credentials = provider
+}
+
+// SetDefaultTag sets the tag pulled when an image has neither a tag nor a
+// digest, "latest" by default. It must be set before the engine is
+// connected.
+func (e *Engine) SetDefaultTag(tag string) {
+	e.defaultTag = tag
+}
+
+// Return the name of the image to pull.
+func (e *Engine) pullName(image string) string {
+	if e.defaultTag == "" {
+		return normalizeImageName(image)
+	}
+	return withDefaultTag(image, e.defaultTag)
+}
+
+// IsPulling returns true if the image is currently being pulled on the engine.
+func (e *Engine) IsPulling(image string) bool {
+	image = e.pullName(image)
+
+	e.pullsLock.Lock()
+	defer e.pullsLock.Unlock()
+	_, exists := e.pulls[image]
+	return exists
+}
+
+// RegisterEventHandler registers an event handler.
+func (e *Engine) RegisterEventHandler(h EventHandler) error {
+	return e.RegisterEventHandlerFiltered(h)
+}
+
+// RegisterEventHandlerFiltered registers an event handler which only receives
+// events matching one of `statuses`. No statuses means all events.
+func (e *Engine) RegisterEventHandlerFiltered(h EventHandler, statuses ...string) error {
+	e.eventsLock.Lock()
+	defer e.eventsLock.Unlock()
+
+	if e.eventHandler != nil {
+		return ErrEventHandlerAlreadySet
+	}
+	e.eventHandler = h
+	e.eventFilter = nil
+	if len(statuses) > 0 {
+		e.eventFilter = make(map[string]bool, len(statuses))
+		for _, status := range statuses {
+			e.eventFilter[status] = true
+		}
+	}
+	return nil
+}
+
+// UnregisterEventHandler removes the event handler of the engine, if any.
+func (e *Engine) UnregisterEventHandler() {
+	e.eventsLock.Lock()
+	e.eventHandler = nil
+	e.eventFilter = nil
+	e.eventsLock.Unlock()
+}
+
+// Subscribe returns a channel receiving the events of the engine, alongside
+// the event handler, and a function to unsubscribe which closes the channel.
+// Events are dropped when the channel is full.
+func (e *Engine) Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, subscriptionBuffer)
+
+	e.eventsLock.Lock()
+	if e.subscribers == nil {
+		e.subscribers = make(map[chan *Event]struct{})
+	}
+	e.subscribers[ch] = struct{}{}
+	e.eventsLock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			e.eventsLock.Lock()
+			delete(e.subscribers, ch)
+			close(ch)
+			e.eventsLock.Unlock()
+		})
+	}
+	return ch, unsubscribe
+}
+
+// Containers returns all the containers in the engine.
+func (e *Engine) Containers() []*Container {
+	unlock := e.observedRLock("containers")
+	containers := make([]*Container, 0, len(e.containers))
+	for _, container := range e.containers {
+		containers = append(containers, container)
+	}
+	unlock()
+	return containers
+}
+
+// Snapshot returns all the containers and images in the engine, both taken
+// at the same point in time.
+func (e *Engine) Snapshot() ([]*Container, []*Image) {
+	unlock := e.observedRLock("snapshot")
+	defer unlock()
+
+	containers := make([]*Container, 0, len(e.containers))
+	for _, container := range e.containers {
+		containers = append(containers, container)
+	}
+	images := make([]*Image, 0, len(e.images))
+	for _, image := range e.images {
+		images = append(images, image)
+	}
+	return containers, images
+}
+
+// Container returns the container with IDOrName in the engine.
+func (e *Engine) Container(IDOrName string) *Container {
+	// Abort immediately if the name is empty.
+	if len(IDOrName) == 0 {
+		return nil
+	}
+
+	// Match exact ID.
+	if container := e.ContainerByID(IDOrName); container != nil {
+		return container
+	}
+
+	// Match name, /name or engine/name.
+	if container := e.ContainerByName(IDOrName); container != nil {
+		return container
+	}
+
+	// Match ID prefix.
+	for _, container := range e.Containers() {
+		if strings.HasPrefix(container.Id, IDOrName) {
+			return container
+		}
+	}
+
+	return nil
+}
+
+// ContainerByName returns the container named name in the engine. The name
+// may have a leading "/" and be prefixed by the ID or the name of the engine,
+// as in "engine/name".
+func (e *Engine) ContainerByName(name string) *Container {
+	if len(name) == 0 {
+		return nil
+	}
+
+	names := []string{"/" + strings.TrimPrefix(name, "/")}
+	for _, engine := range []string{e.ID, e.Name} {
+		if engine != "" && strings.HasPrefix(name, engine+"/") {
+			names = append(names, strings.TrimPrefix(name, engine))
+		}
+	}
+
+	for _, container := range e.Containers() {
+		for _, n := range container.Names {
+			for _, name := range names {
+				if n == name {
+					return container
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ContainerVolumes returns the volumes mounted in a container of the engine.
+func (e *Engine) ContainerVolumes(container *Container) []string {
+	if current := e.ContainerByID(container.Id); current != nil {
+		return current.Volumes()
 	}
+	return []string{}
+}
 
-	// Register the container immediately while waiting for a state refresh.
-	// Force a state refresh to pick up the newly created container.
-	e.refreshContainer(id, true)
+// ContainersUsingVolume returns the containers in the engine mounting the
+// volume name, either a volume name or the source of a bind mount.
+func (e *Engine) ContainersUsingVolume(name string) []*Container {
+	e.RLock()
+	defer e.RUnlock()
+
+	containers := []*Container{}
+	for id := range e.volumeUsers[name] {
+		containers = append(containers, e.containers[id])
+	}
+	return containers
+}
 
+// DanglingVolumes returns the sorted names of the volumes of the engine no
+// container of the engine mounts.
+func (e *Engine) DanglingVolumes() []string {
 	e.RLock()
 	defer e.RUnlock()
 
-	return e.containers[id], nil
+	names := []string{}
+	for _, volume := range e.volumes {
+		if len(e.volumeUsers[volume.Name]) == 0 {
+			names = append(names, volume.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
-// Destroy and remove a container from the engine.
-func (e *Engine) Destroy(container *Container, force bool) error {
-	if err := e.client.RemoveContainer(container.Id, force, true); err != nil {
+// RemoveVolume removes a volume from the engine. Without force, the engine
+// refuses to remove volumes in use.
+func (e *Engine) RemoveVolume(name string, force bool) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if err := client.RemoveVolume(name, force); err != nil {
 		return err
 	}
 
-	// Remove the container from the state. Eventually, the state refresh loop
+	// Remove the volume from the state. Eventually, the state refresh loop
 	// will rewrite this.
 	e.Lock()
 	defer e.Unlock()
-	delete(e.containers, container.Id)
-
+	volumes := make([]*Volume, 0, len(e.volumes))
+	for _, volume := range e.volumes {
+		if volume.Name != name {
+			volumes = append(volumes, volume)
+		}
+	}
+	e.volumes = volumes
 	return nil
 }
 
-// Pull an image on the engine
-func (e *Engine) Pull(image string) error {
-	if !strings.Contains(image, ":") {
-		image = image + ":latest"
+// Move a container from the volumes of old to the volumes of container in
+// the index, either being nil when the container appears or disappears.
+// Called with the lock held.
+func (e *Engine) indexVolumes(old, container *Container) {
+	if old != nil {
+		for _, volume := range old.Volumes() {
+			delete(e.volumeUsers[volume], old.Id)
+			if len(e.volumeUsers[volume]) == 0 {
+				delete(e.volumeUsers, volume)
+			}
+		}
 	}
-	if err := e.client.PullImage(image, nil); err != nil {
-		return err
+	if container != nil {
+		if e.volumeUsers == nil {
+			e.volumeUsers = make(map[string]map[string]bool)
+		}
+		for _, volume := range container.Volumes() {
+			if e.volumeUsers[volume] == nil {
+				e.volumeUsers[volume] = make(map[string]bool)
+			}
+			e.volumeUsers[volume][container.Id] = true
+		}
 	}
+}
 
-	// force refresh images
-	e.RefreshImages()
-
-	return nil
+// ContainersByHealth returns the containers in the engine with the given
+// health status.
+func (e *Engine) ContainersByHealth(status string) []*Container {
+	e.RLock()
+	containers := []*Container{}
+	for _, container := range e.containers {
+		if container.Health() == status {
+			containers = append(containers, container)
+		}
+	}
+	e.RUnlock()
+	return containers
 }
 
-// RegisterEventHandler registers an event handler.
-func (e *Engine) RegisterEventHandler(h EventHandler) error {
-	if e.eventHandler != nil {
-		return errors.New("event handler already set")
+// ContainersByState returns the containers in the engine in the given state.
+func (e *Engine) ContainersByState(state string) []*Container {
+	e.RLock()
+	containers := []*Container{}
+	for _, container := range e.containers {
+		if container.State() == state {
+			containers = append(containers, container)
+		}
 	}
-	e.eventHandler = h
-	return nil
+	e.RUnlock()
+	return containers
 }
 
-// Containers returns all the containers in the engine.
-func (e *Engine) Containers() []*Container {
+// ContainersCreatedSince returns the containers in the engine created at t
+// or later.
+func (e *Engine) ContainersCreatedSince(t time.Time) []*Container {
 	e.RLock()
-	containers := make([]*Container, 0, len(e.containers))
+	containers := []*Container{}
 	for _, container := range e.containers {
-		containers = append(containers, container)
+		if container.Created >= t.Unix() {
+			containers = append(containers, container)
+		}
 	}
 	e.RUnlock()
 	return containers
 }
 
-// Container returns the container with IDOrName in the engine.
-func (e *Engine) Container(IDOrName string) *Container {
-	// Abort immediately if the name is empty.
-	if len(IDOrName) == 0 {
-		return nil
+// ContainersByLabelSelector returns the containers in the engine having all
+// the labels of selector with the same values.
+func (e *Engine) ContainersByLabelSelector(selector map[string]string) []*Container {
+	e.RLock()
+	containers := []*Container{}
+	for _, container := range e.containers {
+		if matchLabels(container, selector) {
+			containers = append(containers, container)
+		}
 	}
+	e.RUnlock()
+	return containers
+}
 
-	for _, container := range e.Containers() {
-		// Match ID prefix.
-		if strings.HasPrefix(container.Id, IDOrName) {
-			return container
+func matchLabels(container *Container, selector map[string]string) bool {
+	for key, value := range selector {
+		if label, exists := container.Label(key); !exists || label != value {
+			return false
 		}
+	}
+	return true
+}
 
-		// Match name, /name or engine/name.
-		for _, name := range container.Names {
-			if name == IDOrName || name == "/"+IDOrName || container.Engine.ID+name == IDOrName || container.Engine.Name+name == IDOrName {
-				return container
-			}
+// ContainerCounts returns the number of containers in the engine per state.
+func (e *Engine) ContainerCounts() map[string]int {
+	e.RLock()
+	counts := make(map[string]int)
+	for _, container := range e.containers {
+		counts[container.State()]++
+	}
+	e.RUnlock()
+	return counts
+}
+
+// SwarmContainers returns the containers of the engine scheduled by swarm.
+func (e *Engine) SwarmContainers() []*Container {
+	e.RLock()
+	containers := []*Container{}
+	for _, container := range e.containers {
+		if container.Info.Config == nil {
+			continue
+		}
+		if _, ok := container.Info.Config.Labels[SwarmIDLabel]; ok {
+			containers = append(containers, container)
 		}
 	}
+	e.RUnlock()
+	return containers
+}
 
-	return nil
+// RestartCount returns the number of times a container died since the
+// engine started tracking it. A high count is a sign of a crash-looping
+// container.
+func (e *Engine) RestartCount(container *Container) int {
+	e.RLock()
+	defer e.RUnlock()
+	return e.restarts[container.Id]
+}
+
+// ExitCode returns the last known exit code of a container, and false if it
+// is unknown because the container is still alive or not known to the engine.
+func (e *Engine) ExitCode(container *Container) (int, bool) {
+	current := e.ContainerByID(container.Id)
+	if current == nil || current.State() != StateExited {
+		return 0, false
+	}
+	return current.Info.State.ExitCode, true
+}
+
+// ContainerByID returns the container with the exact ID in the engine.
+func (e *Engine) ContainerByID(ID string) *Container {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.containers[ID]
 }
 
 // Images returns all the images in the engine
@@ -476,6 +2934,20 @@ func (e *Engine) Image(IDOrName string) *Image {
 	e.RLock()
 	defer e.RUnlock()
 
+	return e.image(IDOrName)
+}
+
+// HasImage returns true if the engine has the image with IDOrName, without
+// asking the daemon.
+func (e *Engine) HasImage(IDOrName string) bool {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.image(IDOrName) != nil
+}
+
+// Must be called with the lock held.
+func (e *Engine) image(IDOrName string) *Image {
 	for _, image := range e.images {
 		if image.Match(IDOrName) {
 			return image
@@ -484,48 +2956,331 @@ func (e *Engine) Image(IDOrName string) *Image {
 	return nil
 }
 
+// ImagesByRepo returns all the images in the engine tagged in repository
+// repo, whatever their tag.
+func (e *Engine) ImagesByRepo(repo string) []*Image {
+	e.RLock()
+	defer e.RUnlock()
+
+	images := []*Image{}
+	for _, image := range e.images {
+		if image.inRepository(repo) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// Volumes returns all the volumes in the engine
+func (e *Engine) Volumes() []*Volume {
+	e.RLock()
+
+	volumes := make([]*Volume, 0, len(e.volumes))
+	for _, volume := range e.volumes {
+		volumes = append(volumes, volume)
+	}
+	e.RUnlock()
+	return volumes
+}
+
+// Volume returns the volume with name in the engine
+func (e *Engine) Volume(name string) *Volume {
+	e.RLock()
+	defer e.RUnlock()
+
+	for _, volume := range e.volumes {
+		if volume.Name == name {
+			return volume
+		}
+	}
+	return nil
+}
+
+// CreateNetwork creates a network on the engine.
+func (e *Engine) CreateNetwork(config *dockerclient.NetworkCreate) (*dockerclient.NetworkCreateResponse, error) {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.Name == "" {
+		return nil, fmt.Errorf("cannot create network on %s: a name is required", e.Addr)
+	}
+
+	response, err := client.CreateNetwork(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick up the new network.
+	if err := e.RefreshNetworks(); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh networks: %v", err)
+	}
+	return response, nil
+}
+
+// RemoveNetwork deletes a network from the engine.
+func (e *Engine) RemoveNetwork(network string) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if network == "" {
+		return fmt.Errorf("cannot remove network on %s: a name or ID is required", e.Addr)
+	}
+
+	if err := client.RemoveNetwork(network); err != nil {
+		return err
+	}
+
+	// Drop the removed network.
+	if err := e.RefreshNetworks(); err != nil {
+		log.WithFields(log.Fields{"name": e.Name, "id": e.ID}).Errorf("Unable to refresh networks: %v", err)
+	}
+	return nil
+}
+
+// ConnectNetwork attaches a container to a network.
+func (e *Engine) ConnectNetwork(network string, container *Container) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return err
+	}
+
+	if err := client.ConnectNetwork(network, container.Id); err != nil {
+		return err
+	}
+
+	// Pick up the new NetworkSettings.
+	return e.refreshContainer(container.Id, true)
+}
+
+// DisconnectNetwork detaches a container from a network.
+func (e *Engine) DisconnectNetwork(network string, container *Container, force bool) error {
+	client, err := e.clientOrErr()
+	if err != nil {
+		return err
+	}
+	if err := e.checkContainer(container); err != nil {
+		return err
+	}
+
+	if err := client.DisconnectNetwork(network, container.Id, force); err != nil {
+		return err
+	}
+
+	// Pick up the new NetworkSettings.
+	return e.refreshContainer(container.Id, true)
+}
+
+// Networks returns all the networks in the engine
+func (e *Engine) Networks() []*Network {
+	e.RLock()
+
+	networks := make([]*Network, 0, len(e.networks))
+	for _, network := range e.networks {
+		networks = append(networks, network)
+	}
+	e.RUnlock()
+	return networks
+}
+
+// Network returns the network with IDOrName in the engine
+func (e *Engine) Network(IDOrName string) *Network {
+	e.RLock()
+	defer e.RUnlock()
+
+	for _, network := range e.networks {
+		if network.Match(IDOrName) {
+			return network
+		}
+	}
+	return nil
+}
+
 func (e *Engine) String() string {
 	return fmt.Sprintf("engine %s addr %s", e.ID, e.Addr)
 }
 
 func (e *Engine) handler(ev *dockerclient.Event, _ chan error, args ...interface{}) {
-	// Something changed - refresh our internal state.
+	e.Lock()
+	if ev.Time > e.lastEventTime {
+		e.lastEventTime = ev.Time
+	}
+	e.eventsSeen = e.clock.Now()
+	e.Unlock()
+
+	// Events may be replayed on reconnect, skip the ones already seen.
+	if !e.newerEvent(ev) {
+		return
+	}
+
+	e.Lock()
+	if ev.Status == "die" {
+		e.restarts[ev.Id]++
+	}
+	paused := e.eventsPaused > 0
+	e.Unlock()
+
+	// Something changed - refresh our internal state, unless ResumeEvents
+	// will.
+	if !paused {
+		e.refreshOnEvent(ev)
+	}
+
+	e.dispatchEvent(&Event{
+		Engine: e,
+		Node:   e.eventNode(),
+		Event:  *ev,
+	})
+}
+
+// lastEvent is the most recent event processed for an object.
+type lastEvent struct {
+	time     int64
+	statuses []string
+}
+
+// Record an event, returning false if it is a duplicate or older than the
+// last event processed for the same object. Events without a timestamp are
+// always processed.
+func (e *Engine) newerEvent(ev *dockerclient.Event) bool {
+	t := ev.TimeNano
+	if t == 0 {
+		t = ev.Time * int64(time.Second)
+	}
+	if t == 0 {
+		return true
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	last, exists := e.lastEvents[ev.Id]
+	switch {
+	case !exists || t > last.time:
+		e.lastEvents[ev.Id] = &lastEvent{time: t, statuses: []string{ev.Status}}
+		return true
+	case t < last.time:
+		return false
+	}
+
+	// Different events may share a timestamp, only skip the same one.
+	for _, status := range last.statuses {
+		if status == ev.Status {
+			return false
+		}
+	}
+	last.statuses = append(last.statuses, ev.Status)
+	return true
+}
+
+// AddContainer inject a container into the internal state.
+func (e *Engine) AddContainer(container *Container) error {
+	e.Lock()
+	if _, ok := e.containers[container.Id]; ok {
+		e.Unlock()
+		return ErrContainerAlreadyExists
+	}
+	e.indexVolumes(nil, container)
+	e.containers[container.Id] = container
+	e.Unlock()
+
+	e.checkOvercommit()
+	return nil
+}
+
+// Refresh the part of the state an event is about.
+func (e *Engine) refreshOnEvent(ev *dockerclient.Event) {
 	switch ev.Status {
 	case "pull", "untag", "delete":
 		// These events refer to images so there's no need to update
 		// containers.
 		e.RefreshImages()
-	case "start", "die":
+	case "start", "die", "restart", "oom":
 		// If the container is started or stopped, we have to do an inspect in
-		// order to get the new NetworkSettings.
+		// order to get the new NetworkSettings, exit code and OOM flag.
 		e.refreshContainer(ev.Id, true)
 	default:
-		// Otherwise, do a "soft" refresh of the container.
-		e.refreshContainer(ev.Id, false)
+		// Health changes are only visible through an inspect. Otherwise, do
+		// a "soft" refresh of the container.
+		e.refreshContainer(ev.Id, strings.HasPrefix(ev.Status, "health_status"))
 	}
+}
 
-	// If there is no event handler registered, abort right now.
-	if e.eventHandler == nil {
-		return
+// PauseEvents stops refreshing the engine state on each of its events, e.g.
+// during bulk operations firing lots of them. The events are still
+// dispatched. Pauses nest, each of them ends with a call to ResumeEvents.
+func (e *Engine) PauseEvents() {
+	e.Lock()
+	e.eventsPaused++
+	e.Unlock()
+}
+
+// ResumeEvents ends a pause of PauseEvents. Once no pause is left, the whole
+// state of the engine is refreshed to catch up with the events received in
+// the meantime. Resuming events which are not paused fails with
+// ErrEventsNotPaused.
+func (e *Engine) ResumeEvents() error {
+	e.Lock()
+	if e.eventsPaused == 0 {
+		e.Unlock()
+		return ErrEventsNotPaused
 	}
+	e.eventsPaused--
+	paused := e.eventsPaused > 0
+	e.Unlock()
 
-	event := &Event{
-		Engine: e,
-		Event:  *ev,
+	if paused {
+		return nil
+	}
+	if err := e.refreshContainers(true); err != nil {
+		return err
 	}
+	return e.RefreshImages()
+}
 
-	e.eventHandler.Handle(event)
+// SetLockObserver registers a function called with the time spent waiting
+// for and holding the engine lock around its main critical sections. It must
+// be set before the engine is connected.
+func (e *Engine) SetLockObserver(observer func(op string, wait, held time.Duration)) {
+	e.lockObserver = observer
 }
 
-// AddContainer inject a container into the internal state.
-func (e *Engine) AddContainer(container *Container) error {
-	e.Lock()
-	defer e.Unlock()
+// Take the engine lock, returning the function releasing it.
+func (e *Engine) observedLock(op string) func() {
+	return e.observe(op, e.Lock, e.Unlock)
+}
 
-	if _, ok := e.containers[container.Id]; ok {
-		return errors.New("container already exists")
+// Take the engine read lock, returning the function releasing it.
+func (e *Engine) observedRLock(op string) func() {
+	return e.observe(op, e.RLock, e.RUnlock)
+}
+
+func (e *Engine) observe(op string, lock, unlock func()) func() {
+	observer := e.lockObserver
+	if observer == nil {
+		lock()
+		return unlock
+	}
+
+	start := time.Now()
+	lock()
+	acquired := time.Now()
+	return func() {
+		held := time.Since(acquired)
+		unlock()
+		observer(op, acquired.Sub(start), held)
+	}
+}
+
+// Make sure a container is known to this engine.
+func (e *Engine) checkContainer(container *Container) error {
+	if container == nil || container.Engine != e || e.ContainerByID(container.Id) == nil {
+		return ErrContainerNotFound
 	}
-	e.containers[container.Id] = container
 	return nil
 }
 
@@ -543,8 +3298,9 @@ func (e *Engine) removeContainer(container *Container) error {
 	defer e.Unlock()
 
 	if _, ok := e.containers[container.Id]; !ok {
-		return errors.New("container not found")
+		return ErrContainerNotFound
 	}
+	e.indexVolumes(e.containers[container.Id], nil)
 	delete(e.containers, container.Id)
 	return nil
 }
@@ -553,5 +3309,6 @@ func (e *Engine) removeContainer(container *Container) error {
 func (e *Engine) cleanupContainers() {
 	e.Lock()
 	e.containers = make(map[string]*Container)
+	e.volumeUsers = nil
 	e.Unlock()
 }
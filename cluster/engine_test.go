@@ -1,9 +1,21 @@
 package cluster
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/samalba/dockerclient"
 	"github.com/samalba/dockerclient/mockclient"
@@ -21,10 +33,82 @@ var (
 		ExecutionDriver: "execution-driver-test",
 		KernelVersion:   "1.2.3",
 		OperatingSystem: "golang",
-		Labels:          []string{"foo=bar"},
+		Labels:          []string{"foo=bar", "equation=a=b=c", "invalid", "in valid=1"},
 	}
 )
 
+type recordingHandler struct {
+	sync.Mutex
+	events []*Event
+}
+
+func (h *recordingHandler) Handle(e *Event) error {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, e)
+	return nil
+}
+
+func (h *recordingHandler) statuses() []string {
+	h.Lock()
+	defer h.Unlock()
+	statuses := []string{}
+	for _, e := range h.events {
+		statuses = append(statuses, e.Status)
+	}
+	return statuses
+}
+
+// Build the info of a running container.
+func runningInfo(config *dockerclient.ContainerConfig) dockerclient.ContainerInfo {
+	info := dockerclient.ContainerInfo{Config: config}
+	info.State.Running = true
+	return info
+}
+
+// Return the info of a container which ran and exited, with config.
+func exitedInfo(config *dockerclient.ContainerConfig) dockerclient.ContainerInfo {
+	info := dockerclient.ContainerInfo{Config: config}
+	info.State.StartedAt = time.Unix(1, 0)
+	return info
+}
+
+// A clock whose timers are fired by the tests.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers chan chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0), timers: make(chan chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	timer := make(chan time.Time, 1)
+	c.timers <- timer
+	return timer
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// Move the clock forward and fire the next timer.
+func (c *fakeClock) fire(d time.Duration) {
+	timer := <-c.timers
+	timer <- c.advance(d)
+}
+
 func TestEngineConnectionFailure(t *testing.T) {
 	engine := NewEngine("test", 0)
 	assert.False(t, engine.isConnected())
@@ -92,6 +176,230 @@ func TestEngineSpecs(t *testing.T) {
 	assert.Equal(t, engine.Labels["kernelversion"], mockInfo.KernelVersion)
 	assert.Equal(t, engine.Labels["operatingsystem"], mockInfo.OperatingSystem)
 	assert.Equal(t, engine.Labels["foo"], "bar")
+	assert.Equal(t, engine.Labels["equation"], "a=b=c")
+	assert.Len(t, engine.Labels, 6)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestLogsTailFollow(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	options := &dockerclient.LogOptions{Follow: true, Stdout: true, Tail: 10, Since: 1000}
+	reader, writer := io.Pipe()
+	client.On("ContainerLogs", "one", options).Return(reader, nil).Once()
+	logs, err := engine.Logs(container, options)
+	assert.NoError(t, err)
+
+	// The tail comes first, followed by the new lines as they are written.
+	go func() {
+		writer.Write([]byte("tail\n"))
+		writer.Write([]byte("new\n"))
+		writer.Close()
+	}()
+	data, err := ioutil.ReadAll(logs)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "tail\nnew\n")
+	assert.NoError(t, logs.Close())
+
+	// Containers of other engines are refused.
+	other := &Container{Container: dockerclient.Container{Id: "two"}, Engine: NewEngine("other", 0)}
+	_, err = engine.Logs(other, options)
+	assert.Equal(t, err, ErrContainerNotFound)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCopyContainer(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	content := strings.NewReader("archive")
+	client.On("PutArchive", "one", "/etc", content).Return(nil).Once()
+	assert.NoError(t, engine.CopyToContainer(container, "/etc", content))
+
+	client.On("GetArchive", "one", "/etc/hosts").Return(ioutil.NopCloser(strings.NewReader("hosts")), nil).Once()
+	archive, err := engine.CopyFromContainer(container, "/etc/hosts")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(archive)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "hosts")
+
+	// Containers of other engines are refused.
+	other := &Container{Container: dockerclient.Container{Id: "two"}, Engine: NewEngine("other", 0)}
+	assert.Equal(t, engine.CopyToContainer(other, "/etc", content), ErrContainerNotFound)
+	_, err = engine.CopyFromContainer(other, "/etc/hosts")
+	assert.Equal(t, err, ErrContainerNotFound)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRateLimit(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetRateLimit(100)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	start := time.Now()
+	assert.NoError(t, engine.connectClient(client))
+	container := engine.Container("one")
+
+	// 5 calls to connect, 100 more fit in the burst, the remaining 45 wait
+	// for the bucket to refill.
+	client.On("TopContainer", "one", "").Return(&dockerclient.ContainerProcessList{}, nil).Times(145)
+	for i := 0; i < 145; i++ {
+		_, err := engine.Top(container, "")
+		assert.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, elapsed.String())
+	assert.True(t, elapsed < 2*time.Second, elapsed.String())
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRateLimitShutdown(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetRateLimit(1)
+	client := mockclient.NewMockClient()
+	engine.client = engine.limitClient(client)
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	// The burst is used up, the next call waits for a second.
+	client.On("TopContainer", "one", "").Return(&dockerclient.ContainerProcessList{}, nil).Once()
+	_, err := engine.Top(container, "")
+	assert.NoError(t, err)
+
+	// Shutting down aborts it.
+	client.On("StopAllMonitorEvents").Return().Once()
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, engine.Shutdown(time.Second))
+		close(done)
+	}()
+	start := time.Now()
+	_, err = engine.Top(container, "")
+	assert.Equal(t, err, ErrShutdown)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	<-done
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestEngineCapabilities(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	info := *mockInfo
+	info.SecurityOptions = []string{"apparmor", "name=seccomp,profile=default"}
+	info.CgroupVersion = "2"
+	info.Plugins.Volume = []string{"local"}
+	info.Plugins.Network = []string{"bridge", "overlay"}
+	client.On("Info").Return(&info, nil)
+	engine.client = client
+
+	assert.False(t, engine.HasCapability("seccomp"))
+	assert.NoError(t, engine.updateSpecs())
+	assert.Equal(t, engine.Capabilities(), []string{"apparmor", "cgroupv2", "network/bridge", "network/overlay", "seccomp", "volume/local"})
+	assert.True(t, engine.HasCapability("seccomp"))
+	assert.True(t, engine.HasCapability("network/overlay"))
+	assert.False(t, engine.HasCapability("selinux"))
+	assert.False(t, engine.HasCapability("log/json-file"))
+}
+
+func TestEngineInfo(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	assert.Nil(t, engine.LastInfo())
+
+	client.On("Info").Return(mockInfo, nil).Once()
+	info, err := engine.Info()
+	assert.NoError(t, err)
+	assert.Equal(t, info, mockInfo)
+	assert.Equal(t, engine.LastInfo(), mockInfo)
+
+	// Specs refreshes update the cached info too.
+	fresh := *mockInfo
+	fresh.Containers = 42
+	client.On("Info").Return(&fresh, nil).Once()
+	assert.NoError(t, engine.updateSpecs())
+	assert.Equal(t, engine.LastInfo().Containers, 42)
+
+	// Failures keep the last info around.
+	client.On("Info").Return(&dockerclient.Info{}, errors.New("fail")).Once()
+	_, err = engine.Info()
+	assert.Error(t, err)
+	assert.Equal(t, engine.LastInfo(), &fresh)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestSetLabel(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	engine.client = client
+
+	assert.NoError(t, engine.SetLabel("maintenance", "true"))
+	assert.NoError(t, engine.SetLabel("foo", "override"))
+	assert.Error(t, engine.SetLabel("in valid", "1"))
+	labels := engine.Labels
+
+	// Manually set labels survive a refresh of the specs.
+	assert.NoError(t, engine.updateSpecs())
+	assert.Equal(t, engine.Labels["maintenance"], "true")
+	assert.Equal(t, engine.Labels["foo"], "override")
+	assert.Equal(t, engine.Labels["storagedriver"], mockInfo.Driver)
+	assert.Len(t, engine.Labels, 7)
+
+	// Removed labels are gone, the daemon ones are restored.
+	engine.RemoveLabel("maintenance")
+	engine.RemoveLabel("foo")
+	_, exists := engine.Labels["maintenance"]
+	assert.False(t, exists)
+	assert.Equal(t, engine.Labels["foo"], "bar")
+	assert.NoError(t, engine.updateSpecs())
+	_, exists = engine.Labels["maintenance"]
+	assert.False(t, exists)
+	assert.Equal(t, engine.Labels["foo"], "bar")
+
+	// Previously read labels are never modified.
+	assert.Len(t, labels, 2)
+}
+
+func TestDaemonLabelsUpdate(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	info := *mockInfo
+	info.Labels = []string{"foo=bar", "old=1"}
+	client.On("Info").Return(&info, nil).Once()
+	engine.client = client
+
+	assert.NoError(t, engine.updateSpecs())
+	assert.NoError(t, engine.SetLabel("zone", "a"))
+
+	// A refresh of the specs replaces the daemon labels only.
+	updated := *mockInfo
+	updated.Labels = []string{"foo=baz", "new=1"}
+	client.On("Info").Return(&updated, nil).Once()
+	assert.NoError(t, engine.updateSpecs())
+	assert.Equal(t, engine.Labels["zone"], "a")
+	assert.Equal(t, engine.Labels["foo"], "baz")
+	assert.Equal(t, engine.Labels["new"], "1")
+	_, exists := engine.Labels["old"]
+	assert.False(t, exists)
 
 	client.Mock.AssertExpectations(t)
 }
@@ -167,6 +475,43 @@ func TestEngineContainerLookup(t *testing.T) {
 	client.Mock.AssertExpectations(t)
 }
 
+func TestEngineContainerByName(t *testing.T) {
+	engine := NewEngine("test-engine", 0)
+	engine.ID = "engine-id"
+	engine.Name = "engine-name"
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "container-id", Names: []string{"/container-name"}}, Engine: engine}))
+
+	for _, name := range []string{
+		"container-name",
+		"/container-name",
+		"engine-id/container-name",
+		"engine-name/container-name",
+	} {
+		container := engine.ContainerByName(name)
+		if assert.NotNil(t, container, name) {
+			assert.Equal(t, container.Id, "container-id")
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		"/",
+		"container",
+		"container-id",
+		"other/container-name",
+		"engine-name/other",
+		"engine-name",
+		"/engine-name/container-name",
+	} {
+		assert.Nil(t, engine.ContainerByName(name), name)
+	}
+
+	// Names take precedence over ID prefixes.
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "container-name-id", Names: []string{"/other"}}, Engine: engine}))
+	assert.Equal(t, engine.Container("container-name").Id, "container-id")
+	assert.Equal(t, engine.Container("container-name-").Id, "container-name-id")
+}
+
 func TestCreateContainer(t *testing.T) {
 	var (
 		config = &dockerclient.ContainerConfig{
@@ -174,6 +519,7 @@ func TestCreateContainer(t *testing.T) {
 			CpuShares: 1,
 			Cmd:       []string{"date"},
 			Tty:       false,
+			Labels:    map[string]string{SwarmIDLabel: "swarm-id"},
 		}
 		engine = NewEngine("test", 0)
 		client = mockclient.NewMockClient()
@@ -188,6 +534,7 @@ func TestCreateContainer(t *testing.T) {
 
 	mockConfig := *config
 	mockConfig.CpuShares = config.CpuShares * 1024 / mockInfo.NCPU
+	mockConfig.Labels = map[string]string{SwarmIDLabel: "swarm-id", CpusLabel: "10"}
 
 	// Everything is ok
 	name := "test1"
@@ -244,3 +591,3128 @@ func TestTotalCpus(t *testing.T) {
 	engine.Cpus = 2
 	assert.Equal(t, engine.TotalCpus(), 2)
 }
+
+func TestReservationLabels(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+
+	// Without labels, the limits are accounted for.
+	config := &dockerclient.ContainerConfig{Memory: 1000, CpuShares: 4}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "limits"}, Info: runningInfo(config), Engine: engine}))
+	assert.Equal(t, engine.UsedMemory(), 1000)
+	assert.Equal(t, engine.UsedCpus(), 4)
+
+	// With labels, the reservations are.
+	config = &dockerclient.ContainerConfig{Memory: 1000, CpuShares: 4, Labels: map[string]string{
+		MemoryReservationLabel: "100",
+		CpuReservationLabel:    "1",
+	}}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "reservations"}, Info: runningInfo(config), Engine: engine}))
+	assert.Equal(t, engine.UsedMemory(), 1100)
+	assert.Equal(t, engine.UsedCpus(), 5)
+	assert.Equal(t, engine.Capacity().UsedMemory, 1100)
+	assert.Equal(t, engine.Capacity().UsedCpus, 5)
+
+	// Create refuses invalid reservations.
+	engine.client = mockclient.NewMockClient()
+	config = &dockerclient.ContainerConfig{Image: "busybox", Labels: map[string]string{MemoryReservationLabel: "lots"}}
+	_, err := engine.Create(config, "test", false)
+	assert.Error(t, err)
+}
+
+func TestGpus(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	assert.Equal(t, engine.TotalGpus(), 0)
+	assert.NoError(t, engine.SetLabel("gpus", "4"))
+	assert.Equal(t, engine.TotalGpus(), 4)
+
+	gpu := [][]string{{"gpu"}}
+	for id, requests := range map[string][]dockerclient.DeviceRequest{
+		"count":  {{Driver: "nvidia", Count: 1, Capabilities: gpu}},
+		"ids":    {{DeviceIDs: []string{"0", "1"}, Capabilities: gpu}},
+		"other":  {{Count: 3, Capabilities: [][]string{{"tpu"}}}},
+		"limits": nil,
+	} {
+		info := dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}, HostConfig: &dockerclient.HostConfig{DeviceRequests: requests}}
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: id}, Info: info, Engine: engine}))
+	}
+	assert.Equal(t, engine.UsedGpus(), 3)
+
+	// A count of -1 requests all the GPUs.
+	info := dockerclient.ContainerInfo{HostConfig: &dockerclient.HostConfig{DeviceRequests: []dockerclient.DeviceRequest{{Count: -1, Capabilities: gpu}}}}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "all"}, Info: info, Engine: engine}))
+	assert.Equal(t, engine.UsedGpus(), 7)
+
+	// Exited containers request nothing by default.
+	info = exitedInfo(&dockerclient.ContainerConfig{})
+	info.HostConfig = &dockerclient.HostConfig{DeviceRequests: []dockerclient.DeviceRequest{{Count: 1, Capabilities: gpu}}}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "exited"}, Info: info, Engine: engine}))
+	assert.Equal(t, engine.UsedGpus(), 7)
+	engine.SetReserveStopped(true)
+	assert.Equal(t, engine.UsedGpus(), 8)
+
+	// Device requests reach the daemon untouched.
+	client := mockclient.NewMockClient()
+	engine.client = client
+	config := &dockerclient.ContainerConfig{Image: "busybox", HostConfig: dockerclient.HostConfig{DeviceRequests: []dockerclient.DeviceRequest{{Count: 2, Capabilities: gpu}}}}
+	client.On("CreateContainer", mock.Anything, "gpu").Return("", errors.New("fail")).Once()
+	_, err := engine.Create(config, "gpu", false)
+	assert.Error(t, err)
+	sent := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, sent.HostConfig.DeviceRequests, config.HostConfig.DeviceRequests)
+}
+
+func TestUtilization(t *testing.T) {
+	engine := NewEngine("test", 0)
+	assert.Equal(t, engine.MemoryUtilization(), 0)
+	assert.Equal(t, engine.CpuUtilization(), 0)
+
+	engine.Memory = 1000
+	engine.Cpus = 4
+	config := &dockerclient.ContainerConfig{Memory: 500, CpuShares: 1}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "under"}, Info: runningInfo(config), Engine: engine}))
+	assert.Equal(t, engine.MemoryUtilization(), 0.5)
+	assert.Equal(t, engine.CpuUtilization(), 0.25)
+
+	config = &dockerclient.ContainerConfig{Memory: 1000, CpuShares: 5}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "over"}, Info: runningInfo(config), Engine: engine}))
+	assert.Equal(t, engine.MemoryUtilization(), 1.5)
+	assert.Equal(t, engine.CpuUtilization(), 1.5)
+
+	// Overcommit raises the totals.
+	engine.overcommitRatio = 50
+	assert.Equal(t, engine.MemoryUtilization(), 1)
+	assert.Equal(t, engine.CpuUtilization(), 1)
+}
+
+func TestRefreshVolumes(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("ListVolumes").Return([]*dockerclient.Volume{
+		{Name: "data", Driver: "local", Mountpoint: "/var/lib/docker/volumes/data"},
+		{Name: "logs", Driver: "local"},
+	}, nil).Once()
+	assert.NoError(t, engine.RefreshVolumes())
+
+	volumes := engine.Volumes()
+	assert.Len(t, volumes, 2)
+	assert.Equal(t, volumes[0].Name, "data")
+	assert.Equal(t, volumes[0].Engine, engine)
+
+	assert.Equal(t, engine.Volume("logs").Name, "logs")
+	assert.Nil(t, engine.Volume("log"))
+	assert.Nil(t, engine.Volume("missing"))
+
+	// The previous volumes are kept on failure.
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, errors.New("fail")).Once()
+	assert.Error(t, engine.RefreshVolumes())
+	assert.Len(t, engine.Volumes(), 2)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRefreshNetworks(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{
+		{ID: "1234567890", Name: "bridge", Driver: "bridge"},
+		{ID: "abcdefghij", Name: "overlay1", Driver: "overlay"},
+	}, nil).Once()
+	assert.NoError(t, engine.RefreshNetworks())
+
+	networks := engine.Networks()
+	assert.Len(t, networks, 2)
+	assert.Equal(t, networks[0].Name, "bridge")
+	assert.Equal(t, networks[0].Engine, engine)
+
+	// Lookup by name, ID or ID prefix.
+	assert.Equal(t, engine.Network("overlay1").ID, "abcdefghij")
+	assert.Equal(t, engine.Network("abcdefghij").Name, "overlay1")
+	assert.Equal(t, engine.Network("123").Name, "bridge")
+	assert.Nil(t, engine.Network("overlay"))
+	assert.Nil(t, engine.Network("missing"))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateRemoveNetwork(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	network := &dockerclient.NetworkResource{ID: "1234567890", Name: "backend", Driver: "bridge"}
+	config := &dockerclient.NetworkCreate{Name: "backend", Driver: "bridge"}
+	client.On("CreateNetwork", config).Return(&dockerclient.NetworkCreateResponse{ID: network.ID}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{network}, nil).Once()
+	response, err := engine.CreateNetwork(config)
+	assert.NoError(t, err)
+	assert.Equal(t, response.ID, network.ID)
+	assert.NotNil(t, engine.Network("backend"))
+
+	client.On("RemoveNetwork", "backend").Return(nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	assert.NoError(t, engine.RemoveNetwork("backend"))
+	assert.Nil(t, engine.Network("backend"))
+
+	client.On("RemoveNetwork", "backend").Return(errors.New("fail")).Once()
+	assert.Error(t, engine.RemoveNetwork("backend"))
+
+	// Invalid inputs never reach the daemon.
+	_, err = engine.CreateNetwork(nil)
+	assert.Error(t, err)
+	_, err = engine.CreateNetwork(&dockerclient.NetworkCreate{})
+	assert.Error(t, err)
+	assert.Error(t, engine.RemoveNetwork(""))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestConnectDisconnectNetwork(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	connected := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	connected.NetworkSettings.IPAddress = "10.0.0.2"
+	client.On("ConnectNetwork", "backend", "one").Return(nil).Once()
+	client.On("ListContainers", true, false, `{"id":["one"]}`).Return([]dockerclient.Container{{Id: "one"}}, nil).Twice()
+	client.On("InspectContainer", "one").Return(connected, nil).Once()
+	assert.NoError(t, engine.ConnectNetwork("backend", container))
+	assert.Equal(t, engine.ContainerByID("one").Info.NetworkSettings.IPAddress, "10.0.0.2")
+
+	disconnected := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	client.On("DisconnectNetwork", "backend", "one", true).Return(nil).Once()
+	client.On("InspectContainer", "one").Return(disconnected, nil).Once()
+	assert.NoError(t, engine.DisconnectNetwork("backend", container, true))
+	assert.Empty(t, engine.ContainerByID("one").Info.NetworkSettings.IPAddress)
+
+	client.On("ConnectNetwork", "backend", "one").Return(errors.New("fail")).Once()
+	assert.Error(t, engine.ConnectNetwork("backend", container))
+
+	// Containers of other engines are refused.
+	other := &Container{Container: dockerclient.Container{Id: "two"}, Engine: NewEngine("other", 0)}
+	assert.Error(t, engine.ConnectNetwork("backend", other))
+	assert.Error(t, engine.DisconnectNetwork("backend", other, false))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRefreshImagesEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	// The first refresh only discovers the images.
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "one", RepoTags: []string{"busybox:latest"}}, {Id: "two"}}, nil).Once()
+	assert.NoError(t, engine.RefreshImages())
+	assert.Empty(t, handler.statuses())
+
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "two"}, {Id: "three", RepoTags: []string{"redis:latest"}}}, nil).Once()
+	assert.NoError(t, engine.RefreshImages())
+	assert.Equal(t, handler.statuses(), []string{"image_added", "image_removed"})
+	assert.Equal(t, handler.events[0].Id, "three")
+	assert.Equal(t, handler.events[0].RepoTags, []string{"redis:latest"})
+	assert.Equal(t, handler.events[1].Id, "one")
+	assert.Equal(t, handler.events[1].RepoTags, []string{"busybox:latest"})
+
+	// No changes, no events.
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "two"}, {Id: "three"}}, nil).Once()
+	assert.NoError(t, engine.RefreshImages())
+	assert.Len(t, handler.statuses(), 2)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestHasImage(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.images = []*Image{
+		{Image: dockerclient.Image{Id: "abcdef", RepoTags: []string{"busybox:latest"}}, Engine: engine},
+		{Image: dockerclient.Image{Id: "123456", RepoTags: []string{"redis:3"}}, Engine: engine},
+	}
+
+	for _, name := range []string{"busybox", "busybox:latest", "abcdef", "abc", "redis:3", "123456"} {
+		assert.True(t, engine.HasImage(name), name)
+		assert.NotNil(t, engine.Image(name), name)
+	}
+	for _, name := range []string{"nginx", "redis:2", "busybox:1", "ab"} {
+		assert.False(t, engine.HasImage(name), name)
+		assert.Nil(t, engine.Image(name), name)
+	}
+}
+
+func TestImagesByRepo(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.images = []*Image{
+		{Image: dockerclient.Image{Id: "1", RepoTags: []string{"myapp:1.0"}}, Engine: engine},
+		{Image: dockerclient.Image{Id: "2", RepoTags: []string{"myapp:2.0", "myapp:latest"}}, Engine: engine},
+		{Image: dockerclient.Image{Id: "3", RepoTags: []string{"myapp-other:1.0"}}, Engine: engine},
+		{Image: dockerclient.Image{Id: "4", RepoTags: []string{"<none>:<none>"}}, Engine: engine},
+		{Image: dockerclient.Image{Id: "5", RepoTags: []string{"registry:5000/myapp:1.0"}}, Engine: engine},
+	}
+
+	images := engine.ImagesByRepo("myapp")
+	assert.Len(t, images, 2)
+	assert.Equal(t, images[0].Id, "1")
+	assert.Equal(t, images[1].Id, "2")
+
+	// A tag in the repository name is ignored.
+	assert.Len(t, engine.ImagesByRepo("myapp:1.0"), 2)
+
+	images = engine.ImagesByRepo("registry:5000/myapp")
+	assert.Len(t, images, 1)
+	assert.Equal(t, images[0].Id, "5")
+
+	assert.Empty(t, engine.ImagesByRepo("<none>"))
+	assert.Empty(t, engine.ImagesByRepo("missing"))
+}
+
+func TestContainerByID(t *testing.T) {
+	engine := NewEngine("test", 0)
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "container-id"}, Engine: engine}))
+
+	assert.NotNil(t, engine.ContainerByID("container-id"))
+	// Prefixes are only resolved by Container().
+	assert.Nil(t, engine.ContainerByID("container-"))
+	assert.NotNil(t, engine.Container("container-"))
+	assert.Nil(t, engine.ContainerByID(""))
+}
+
+func TestEventWatchdog(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.setHealthy(true)
+	clock := newFakeClock()
+	engine.clock = clock
+	engine.SetEventWatchdog(time.Minute)
+
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	engine.startMonitorEvents()
+	engine.checkEventStream()
+
+	// The engine is idle but answers, the stream is left alone.
+	clock.advance(time.Minute)
+	client.On("Ping").Return(nil).Once()
+	engine.checkEventStream()
+	engine.checkEventStream()
+
+	// Events keep the stream alive.
+	clock.advance(time.Minute)
+	client.On("ListContainers", true, false, mock.Anything).Return([]dockerclient.Container{}, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "one", Status: "create", Time: 1}, nil)
+	engine.checkEventStream()
+
+	// The connection went stale, monitoring starts over on a fresh client.
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	fresh := mockclient.NewMockClient()
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return fresh, nil
+	}
+	clock.advance(time.Minute)
+	client.On("Ping").Return(errors.New("stale")).Once()
+	client.On("StopAllMonitorEvents").Return().Once()
+	fresh.On("StartMonitorEventsSince", int64(1), mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	engine.checkEventStream()
+	engine.checkEventStream()
+
+	client.Mock.AssertExpectations(t)
+	fresh.Mock.AssertExpectations(t)
+}
+
+func TestRefreshLoopClock(t *testing.T) {
+	engine := NewEngine("test", 0)
+	clock := newFakeClock()
+	engine.clock = clock
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Twice()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Twice()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Twice()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Twice()
+
+	done := make(chan struct{})
+	go func() {
+		engine.refreshLoop()
+		close(done)
+	}()
+
+	// Each tick of the clock refreshes the engine, the next timer is only
+	// set once the refresh is over.
+	clock.fire(stateRefreshPeriod)
+	clock.fire(stateRefreshPeriod)
+	<-clock.timers
+	assert.Equal(t, engine.LastUpdate(), time.Unix(1000, 0).Add(2*stateRefreshPeriod))
+
+	close(engine.stop)
+	<-done
+
+	// Synthetic events are stamped by the clock too.
+	assert.Equal(t, engine.newEvent("engine_connect").Time, clock.Now().Unix())
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestKeepAliveDialer(t *testing.T) {
+	dialer := newDialer()
+	assert.Equal(t, dialer.KeepAlive, tcpKeepAlive)
+	assert.Equal(t, dialer.Timeout, connectTimeout)
+
+	// The connections of the clients go through it.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	defer func(f func() *net.Dialer) { newDialer = f }(newDialer)
+	dialed := 0
+	newDialer = func() *net.Dialer {
+		dialed++
+		return dialer
+	}
+	client, err := newClient(listener.Addr().String(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dialed, 1)
+	transport := client.(*dockerclient.DockerClient).HTTPClient.Transport.(*http.Transport)
+	conn, err := transport.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+}
+
+func TestPingLoop(t *testing.T) {
+	engine := NewEngine("test", 0)
+	clock := newFakeClock()
+	engine.clock = clock
+	engine.SetPingPeriod(5 * time.Second)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("Ping").Return(nil).Once()
+	client.On("Ping").Return(errors.New("stale")).Once()
+
+	done := make(chan struct{})
+	go func() {
+		engine.pingLoop()
+		close(done)
+	}()
+
+	// A successful ping leaves the engine alone.
+	clock.fire(5 * time.Second)
+	clock.fire(5 * time.Second)
+
+	// A failed one triggers a refresh.
+	<-engine.ch
+	<-clock.timers
+
+	close(engine.stop)
+	<-done
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRefreshPeriodJitter(t *testing.T) {
+	engine := NewEngine("test", 0)
+
+	// Refreshes are spread within 10% of the period by default.
+	min, max := stateRefreshPeriod, stateRefreshPeriod
+	for i := 0; i < 1000; i++ {
+		period := engine.refreshPeriod()
+		assert.True(t, period >= stateRefreshPeriod*9/10)
+		assert.True(t, period <= stateRefreshPeriod*11/10)
+		if period < min {
+			min = period
+		}
+		if period > max {
+			max = period
+		}
+	}
+	assert.True(t, min < stateRefreshPeriod)
+	assert.True(t, max > stateRefreshPeriod)
+
+	engine.SetRefreshJitter(0.5)
+	for i := 0; i < 1000; i++ {
+		period := engine.refreshPeriod()
+		assert.True(t, period >= stateRefreshPeriod/2)
+		assert.True(t, period <= stateRefreshPeriod*3/2)
+	}
+
+	engine.SetRefreshJitter(0)
+	assert.Equal(t, engine.refreshPeriod(), stateRefreshPeriod)
+}
+
+func TestSnapshot(t *testing.T) {
+	engine := NewEngine("test", 0)
+
+	// Containers and images are always replaced together.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("%d", i)
+			engine.Lock()
+			engine.containers = map[string]*Container{id: {Container: dockerclient.Container{Id: id}, Engine: engine}}
+			engine.images = []*Image{{Image: dockerclient.Image{Id: id}, Engine: engine}}
+			engine.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		containers, images := engine.Snapshot()
+		if len(containers) == 0 {
+			assert.Empty(t, images)
+			continue
+		}
+		assert.Len(t, containers, 1)
+		assert.Len(t, images, 1)
+		assert.Equal(t, containers[0].Id, images[0].Id)
+	}
+}
+
+func benchmarkEngine(n int) (*Engine, string) {
+	engine := NewEngine("test", 0)
+	var id string
+	for i := 0; i < n; i++ {
+		id = fmt.Sprintf("%064d", i)
+		engine.AddContainer(&Container{Container: dockerclient.Container{Id: id, Names: []string{fmt.Sprintf("/name%d", i)}}, Engine: engine})
+	}
+	return engine, id
+}
+
+func BenchmarkContainerByID(b *testing.B) {
+	engine, id := benchmarkEngine(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.ContainerByID(id)
+	}
+}
+
+func BenchmarkContainerPrefix(b *testing.B) {
+	engine, id := benchmarkEngine(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.Container(id[:32])
+	}
+}
+
+func TestRuntimes(t *testing.T) {
+	var info dockerclient.Info
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"ID": "id",
+		"NCPU": 4,
+		"MemTotal": 1024,
+		"Runtimes": {
+			"runc": {"path": "runc"},
+			"runsc": {"path": "/usr/local/bin/runsc", "runtimeArgs": ["--platform=ptrace"]}
+		},
+		"DefaultRuntime": "runc"
+	}`), &info))
+
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	assert.False(t, engine.HasRuntime("runc"))
+
+	client.On("Info").Return(&info, nil).Once()
+	assert.NoError(t, engine.updateSpecs())
+	assert.True(t, engine.HasRuntime("runc"))
+	assert.True(t, engine.HasRuntime("runsc"))
+	assert.False(t, engine.HasRuntime("kata"))
+	assert.Equal(t, engine.DefaultRuntime(), "runc")
+
+	// The requested runtime is passed through untouched.
+	config := &dockerclient.ContainerConfig{Image: "busybox", HostConfig: dockerclient.HostConfig{Runtime: "runsc"}}
+	client.On("CreateContainer", mock.Anything, "").Return("one", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: config}, nil).Once()
+	_, err := engine.Create(config, "", false)
+	assert.NoError(t, err)
+	created := client.Mock.Calls[1].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, created.HostConfig.Runtime, "runsc")
+
+	// Runtimes missing from the engine are refused.
+	config.HostConfig.Runtime = "kata"
+	_, err = engine.Create(config, "", false)
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateWithProgress(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.Cpus = mockInfo.NCPU
+
+	var statuses []string
+	callback := func(what, status string) {
+		statuses = append(statuses, what+": "+status)
+	}
+
+	config := &dockerclient.ContainerConfig{Image: "busybox"}
+	client.On("CreateContainer", mock.Anything, "web").Return("", dockerclient.ErrNotFound).Once()
+	client.On("PullImage", "busybox:latest", mock.Anything).Return(nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("CreateContainer", mock.Anything, "web").Return("one", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: config}, nil).Once()
+	_, err := engine.CreateWithProgress(config, "web", true, callback)
+	assert.NoError(t, err)
+	assert.Equal(t, statuses, []string{"busybox: pulling", "busybox: downloaded", "busybox: creating"})
+
+	// Failed pulls are reported, their error is returned.
+	statuses = nil
+	client.On("CreateContainer", mock.Anything, "web").Return("", dockerclient.ErrNotFound).Once()
+	client.On("PullImage", "busybox:latest", mock.Anything).Return(errors.New("denied")).Once()
+	_, err = engine.CreateWithProgress(config, "web", true, callback)
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, statuses, []string{"busybox: pulling", "busybox: failed"})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateIdempotencyKey(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.Cpus = mockInfo.NCPU
+	engine.images = []*Image{{Image: dockerclient.Image{Id: "busybox", RepoTags: []string{"busybox:latest"}}, Engine: engine}}
+
+	config := &dockerclient.ContainerConfig{Image: "busybox", Labels: map[string]string{IdempotencyKeyLabel: "deploy-1"}}
+	filters := fmt.Sprintf(`{"label":[%q]}`, IdempotencyKeyLabel+"=deploy-1")
+
+	client.On("ListContainers", true, false, filters).Return([]dockerclient.Container{}, nil).Once()
+	client.On("CreateContainer", mock.Anything, "web").Return("one", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Twice()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: config}, nil).Twice()
+	first, err := engine.Create(config, "web", false)
+	assert.NoError(t, err)
+
+	// The retry finds the container rather than creating another one.
+	client.On("ListContainers", true, false, filters).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	second, err := engine.Create(config, "web", false)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Id, first.Id)
+	assert.Len(t, engine.Containers(), 1)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateContainerHostConfig(t *testing.T) {
+	var (
+		config = &dockerclient.ContainerConfig{
+			Image:     "busybox",
+			CpuShares: 1,
+			HostConfig: dockerclient.HostConfig{
+				Binds:         []string{"/data:/data"},
+				Privileged:    true,
+				PortBindings:  map[string][]dockerclient.PortBinding{"80/tcp": {{HostPort: "8080"}}},
+				RestartPolicy: dockerclient.RestartPolicy{Name: "always"},
+			},
+		}
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.client = client
+	engine.Cpus = mockInfo.NCPU
+
+	id := "id1"
+	client.On("CreateContainer", mock.Anything, "test1").Return(id, nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, id)).Return([]dockerclient.Container{{Id: id}}, nil).Once()
+	client.On("InspectContainer", id).Return(&dockerclient.ContainerInfo{Config: config, HostConfig: &config.HostConfig}, nil).Once()
+	_, err := engine.Create(config, "test1", false)
+	assert.NoError(t, err)
+
+	created := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, created.HostConfig, config.HostConfig)
+
+	// The host config must be part of the create request itself.
+	data, err := json.Marshal(created)
+	assert.NoError(t, err)
+	var body struct {
+		HostConfig dockerclient.HostConfig
+	}
+	assert.NoError(t, json.Unmarshal(data, &body))
+	assert.Equal(t, body.HostConfig, config.HostConfig)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestMaxContainers(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.Cpus = mockInfo.NCPU
+	engine.SetMaxContainers(2)
+	engine.addImage(&Image{Image: dockerclient.Image{Id: "image-id", RepoTags: []string{"busybox:latest"}}, Engine: engine})
+
+	config := &dockerclient.ContainerConfig{Image: "busybox"}
+	for _, id := range []string{"one", "two"} {
+		assert.NoError(t, engine.CanCreate(config, id, false))
+		client.On("CreateContainer", mock.Anything, id).Return(id, nil).Once()
+		client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, id)).Return([]dockerclient.Container{{Id: id}}, nil).Once()
+		client.On("InspectContainer", id).Return(&dockerclient.ContainerInfo{Config: config}, nil).Once()
+		_, err := engine.Create(config, id, false)
+		assert.NoError(t, err)
+	}
+
+	// The limit is reached, the engine is not even asked.
+	_, err := engine.Create(config, "three", false)
+	assert.Error(t, err)
+	assert.Error(t, engine.CanCreate(config, "three", false))
+
+	// Batches count the containers created so far.
+	engine.SetMaxContainers(3)
+	client.On("CreateContainer", mock.Anything, "three").Return("three", nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}, {Id: "two"}, {Id: "three"}}, nil).Once()
+	client.On("InspectContainer", "three").Return(&dockerclient.ContainerInfo{Config: config}, nil).Once()
+	containers, errs := engine.CreateBatch([]*dockerclient.ContainerConfig{config, config}, []string{"three", "four"}, false)
+	assert.NoError(t, errs[0])
+	assert.NotNil(t, containers[0])
+	assert.Error(t, errs[1])
+	assert.Nil(t, containers[1])
+
+	// 0 lifts the limit.
+	engine.SetMaxContainers(0)
+	assert.NoError(t, engine.CanCreate(config, "four", false))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateContainerNoCpus(t *testing.T) {
+	var (
+		config = &dockerclient.ContainerConfig{
+			Image:     "busybox",
+			CpuShares: 1,
+		}
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.client = client
+
+	// Cpus is still zero, Create must fail without reaching the daemon.
+	container, err := engine.Create(config, "test1", false)
+	assert.Error(t, err)
+	assert.Nil(t, container)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestDestroy(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	for _, removeVolumes := range []bool{true, false} {
+		container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+		assert.NoError(t, engine.AddContainer(container))
+
+		client.On("RemoveContainer", "one", false, removeVolumes).Return(nil).Once()
+		assert.NoError(t, engine.Destroy(container, false, removeVolumes))
+		assert.Nil(t, engine.ContainerByID("one"))
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestDestroyBatch(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	for _, removeVolumes := range []bool{true, false} {
+		containers := []*Container{}
+		for _, id := range []string{"one", "two", "three"} {
+			container := &Container{Container: dockerclient.Container{Id: id}, Engine: engine}
+			assert.NoError(t, engine.AddContainer(container))
+			containers = append(containers, container)
+		}
+
+		client.On("RemoveContainer", "one", true, removeVolumes).Return(nil).Once()
+		client.On("RemoveContainer", "two", true, removeVolumes).Return(errors.New("fail")).Once()
+		client.On("RemoveContainer", "three", true, removeVolumes).Return(nil).Once()
+		// A single refresh drops every removed container.
+		client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "two"}}, nil).Once()
+
+		errs := engine.DestroyBatch(containers, true, removeVolumes)
+		assert.Len(t, errs, 3)
+		assert.NoError(t, errs[0])
+		assert.Error(t, errs[1])
+		assert.NoError(t, errs[2])
+		assert.Len(t, engine.Containers(), 1)
+		assert.NotNil(t, engine.ContainerByID("two"))
+		assert.NoError(t, engine.removeContainer(containers[1]))
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateNameConflict(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("CreateContainer", mock.Anything, "test1").Return("id1", nil).Once()
+	client.On("ListContainers", true, false, `{"id":["id1"]}`).Return([]dockerclient.Container{{Id: "id1", Names: []string{"/test1"}}}, nil).Once()
+	client.On("InspectContainer", "id1").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "test1", false)
+	assert.NoError(t, err)
+
+	// The name is taken, with or without the leading "/".
+	for _, name := range []string{"test1", "/test1"} {
+		container, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, name, false)
+		assert.Equal(t, err, ErrNameConflict)
+		assert.Nil(t, container)
+	}
+
+	// A name matching an ID prefix is not a conflict.
+	client.On("CreateContainer", mock.Anything, "id").Return("", errors.New("fail")).Once()
+	_, err = engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "id", false)
+	assert.EqualError(t, err, "fail")
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCanCreate(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = 4
+	engine.Memory = 1000
+	engine.addImage(&Image{Image: dockerclient.Image{Id: "image-id", RepoTags: []string{"busybox:latest"}}, Engine: engine})
+	config := &dockerclient.ContainerConfig{Memory: 500, CpuShares: 2}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one", Names: []string{"/used"}}, Info: runningInfo(config), Engine: engine}))
+
+	assert.NoError(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox", Memory: 500, CpuShares: 2}, "free", false))
+
+	// The name is taken.
+	assert.Equal(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox"}, "used", false), ErrNameConflict)
+
+	// Not enough resources.
+	assert.Error(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox", Memory: 501}, "free", false))
+	assert.Error(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox", CpuShares: 3}, "free", false))
+
+	// The reservation is what matters.
+	reserved := &dockerclient.ContainerConfig{Image: "busybox", Memory: 1000, Labels: map[string]string{MemoryReservationLabel: "100"}}
+	assert.NoError(t, engine.CanCreate(reserved, "free", false))
+
+	// The image is missing, which only matters when it won't be pulled.
+	assert.Equal(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "missing"}, "free", false), ErrImageNotFound)
+	assert.NoError(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "missing"}, "free", true))
+
+	// Invalid configurations.
+	assert.Error(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox", CpusetCpus: "4"}, "free", false))
+
+	// The engine doesn't accept containers.
+	engine.Cordon()
+	assert.Error(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox"}, "free", false))
+	engine.Uncordon()
+
+	// The CPUs are unknown.
+	engine.Cpus = 0
+	assert.Error(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox"}, "free", false))
+}
+
+func TestCordon(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	container.Info.State.Running = true
+	assert.NoError(t, engine.AddContainer(container))
+
+	assert.False(t, engine.IsCordoned())
+	engine.Cordon()
+	assert.True(t, engine.IsCordoned())
+
+	// New containers are refused.
+	_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "test1", false)
+	assert.Equal(t, err, ErrCordoned)
+
+	// Existing ones can still be stopped and destroyed.
+	client.On("StopContainer", "one", 10).Return(nil).Once()
+	client.On("ListContainers", true, false, `{"id":["one"]}`).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	assert.Empty(t, engine.DrainContainers(10))
+	client.On("RemoveContainer", "one", false, true).Return(nil).Once()
+	assert.NoError(t, engine.Destroy(container, false, true))
+
+	engine.Uncordon()
+	assert.False(t, engine.IsCordoned())
+	client.On("CreateContainer", mock.Anything, "test1").Return("", errors.New("fail")).Once()
+	_, err = engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "test1", false)
+	assert.EqualError(t, err, "fail")
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateHook(t *testing.T) {
+	var (
+		config = &dockerclient.ContainerConfig{
+			Image:     "busybox",
+			CpuShares: 1,
+		}
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.client = client
+	engine.Cpus = mockInfo.NCPU
+
+	var seen *dockerclient.ContainerConfig
+	engine.SetCreateHook(func(config *dockerclient.ContainerConfig) error {
+		seen = config
+		return errors.New("policy violation")
+	})
+
+	// A rejecting hook prevents the create call.
+	container, err := engine.Create(config, "test1", false)
+	assert.EqualError(t, err, "policy violation")
+	assert.Nil(t, container)
+
+	// The hook sees the original configuration.
+	assert.Equal(t, seen, config)
+	assert.Equal(t, seen.CpuShares, 1)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateContainerCpuset(t *testing.T) {
+	var (
+		config = &dockerclient.ContainerConfig{
+			Image:      "busybox",
+			CpuShares:  2,
+			CpusetCpus: "0-1,3",
+			CpusetMems: "0",
+			Labels:     map[string]string{SwarmIDLabel: "swarm-id"},
+		}
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.client = client
+	engine.Cpus = 4
+
+	client.On("CreateContainer", mock.Anything, "test1").Return("id1", nil).Once()
+	client.On("ListContainers", true, false, `{"id":["id1"]}`).Return([]dockerclient.Container{{Id: "id1"}}, nil).Once()
+	client.On("InspectContainer", "id1").Return(&dockerclient.ContainerInfo{Config: config}, nil).Once()
+	_, err := engine.Create(config, "test1", false)
+	assert.NoError(t, err)
+
+	// The cpusets reach the daemon untouched, only CpuShares is scaled.
+	sent := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, sent.CpusetCpus, "0-1,3")
+	assert.Equal(t, sent.CpusetMems, "0")
+	assert.Equal(t, sent.CpuShares, 2*1024/4)
+
+	// Cpusets beyond the engine CPUs are refused.
+	for _, cpuset := range []string{"4", "0-4", "3-1", "a", "1,"} {
+		config.CpusetCpus = cpuset
+		_, err = engine.Create(config, "test2", false)
+		assert.Error(t, err)
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestUpdateResources(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	before := runningInfo(&dockerclient.ContainerConfig{Memory: 10, CpuShares: 1024})
+	client.On("InspectContainer", "one").Return(&before, nil).Once()
+	assert.NoError(t, engine.connectClient(client))
+	assert.Equal(t, engine.UsedMemory(), 10)
+
+	container := engine.Container("one")
+	client.On("UpdateContainer", "one", &dockerclient.UpdateConfig{Memory: 20, CpuShares: 2 * 1024 / mockInfo.NCPU}).Return(nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	after := runningInfo(&dockerclient.ContainerConfig{Memory: 20, CpuShares: 2048})
+	client.On("InspectContainer", "one").Return(&after, nil).Once()
+	assert.NoError(t, engine.UpdateResources(container, 20, 2))
+	assert.Equal(t, engine.UsedMemory(), 20)
+	assert.Equal(t, engine.UsedCpus(), 2048*1024/mockInfo.NCPU)
+
+	// Containers of other engines are refused.
+	other := &Container{Container: dockerclient.Container{Id: "two"}, Engine: NewEngine("other", 0)}
+	assert.Error(t, engine.UpdateResources(other, 20, 2))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestUpdateResourcesEvent(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Info: exitedInfo(&dockerclient.ContainerConfig{Memory: 10, CpuShares: 1}), Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	client.On("UpdateContainer", "one", mock.Anything).Return(nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	after := exitedInfo(&dockerclient.ContainerConfig{Memory: 20, CpuShares: 20})
+	client.On("InspectContainer", "one").Return(&after, nil).Once()
+	assert.NoError(t, engine.UpdateResources(container, 20, 2))
+
+	assert.Equal(t, handler.statuses(), []string{"container_resize"})
+	ev := handler.events[0]
+	assert.Equal(t, ev.Id, "one")
+	assert.Equal(t, *ev.Resize, ResourceChange{OldMemory: 10, NewMemory: 20, OldCpus: 1, NewCpus: 20 * 1024 / mockInfo.NCPU})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestWait(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	info := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	info.State.ExitCode = 3
+	client.On("WaitContainer", "one").Return(3, nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one", Status: "Exited (3)"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(info, nil).Once()
+
+	code, err := engine.Wait(container)
+	assert.NoError(t, err)
+	assert.Equal(t, code, 3)
+	assert.Equal(t, engine.Container("one").Info.State.ExitCode, 3)
+
+	client.On("WaitContainer", "one").Return(-1, errors.New("fail")).Once()
+	_, err = engine.Wait(container)
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestTop(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	list := &dockerclient.ContainerProcessList{
+		Titles:    []string{"PID", "CMD"},
+		Processes: [][]string{{"1", "sleep 100"}},
+	}
+	client.On("TopContainer", "one", "aux").Return(list, nil).Once()
+	processes, err := engine.Top(container, "aux")
+	assert.NoError(t, err)
+	assert.Equal(t, processes, list)
+
+	// Containers of other engines are refused.
+	other := &Container{Container: dockerclient.Container{Id: "two"}, Engine: NewEngine("other", 0)}
+	_, err = engine.Top(other, "")
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+// blockingInspectClient holds every InspectContainer call until released.
+type blockingInspectClient struct {
+	*mockclient.MockClient
+	release chan struct{}
+}
+
+func (c *blockingInspectClient) InspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	<-c.release
+	return c.MockClient.InspectContainer(id)
+}
+
+func TestRefreshContainerCoalescesInspects(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := &blockingInspectClient{mockclient.NewMockClient(), make(chan struct{})}
+	engine.client = client
+
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil)
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{CpuShares: 1024}}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, engine.refreshContainer("one", true))
+		}()
+	}
+	// Give every refresh the time to queue up behind the first inspect.
+	time.Sleep(100 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+
+	client.Mock.AssertNumberOfCalls(t, "InspectContainer", 1)
+	assert.Len(t, engine.Containers(), 1)
+	// CpuShares must only be scaled once.
+	assert.Equal(t, engine.Container("one").Info.Config.CpuShares, 1024*1024/mockInfo.NCPU)
+}
+
+func TestCommit(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	client.On("CommitContainer", "one", "repo", "tag", (*dockerclient.ContainerConfig)(nil)).Return("image-id", nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "image-id", RepoTags: []string{"repo:tag"}}}, nil).Once()
+
+	image, err := engine.Commit(container, "repo", "tag", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Id, "image-id")
+	assert.Equal(t, image.Engine, engine)
+
+	// Unknown containers are refused.
+	_, err = engine.Commit(&Container{Engine: NewEngine("other", 0)}, "repo", "tag", nil)
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestContainersByState(t *testing.T) {
+	engine := NewEngine("test", 0)
+
+	running := &Container{Container: dockerclient.Container{Id: "running"}, Engine: engine}
+	running.Info.State.Running = true
+	paused := &Container{Container: dockerclient.Container{Id: "paused"}, Engine: engine}
+	paused.Info.State.Running = true
+	paused.Info.State.Paused = true
+	restarting := &Container{Container: dockerclient.Container{Id: "restarting"}, Engine: engine}
+	restarting.Info.State.Running = true
+	restarting.Info.State.Restarting = true
+	created := &Container{Container: dockerclient.Container{Id: "created"}, Engine: engine}
+	exited := &Container{Container: dockerclient.Container{Id: "exited"}, Info: exitedInfo(nil), Engine: engine}
+
+	for _, c := range []*Container{running, paused, restarting, created, exited} {
+		assert.NoError(t, engine.AddContainer(c))
+	}
+
+	for state, c := range map[string]*Container{
+		StateRunning:    running,
+		StatePaused:     paused,
+		StateRestarting: restarting,
+		StateCreated:    created,
+		StateExited:     exited,
+	} {
+		containers := engine.ContainersByState(state)
+		assert.Len(t, containers, 1)
+		assert.Equal(t, containers[0], c)
+	}
+	assert.Len(t, engine.ContainersByState("unknown"), 0)
+}
+
+func TestContainerCounts(t *testing.T) {
+	engine := NewEngine("test", 0)
+	assert.Empty(t, engine.ContainerCounts())
+
+	for i := 0; i < 3; i++ {
+		c := &Container{Container: dockerclient.Container{Id: fmt.Sprintf("running%d", i)}, Engine: engine}
+		c.Info.State.Running = true
+		assert.NoError(t, engine.AddContainer(c))
+	}
+	paused := &Container{Container: dockerclient.Container{Id: "paused"}, Engine: engine}
+	paused.Info.State.Running = true
+	paused.Info.State.Paused = true
+	assert.NoError(t, engine.AddContainer(paused))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: fmt.Sprintf("exited%d", i)}, Info: exitedInfo(nil), Engine: engine}))
+	}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "created"}, Engine: engine}))
+
+	assert.Equal(t, engine.ContainerCounts(), map[string]int{
+		StateRunning: 3,
+		StatePaused:  1,
+		StateCreated: 1,
+		StateExited:  5,
+	})
+}
+
+func TestEvictStaleContainers(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.setHealthy(true)
+
+	stale := &Container{Container: dockerclient.Container{Id: "stale"}, Engine: engine}
+	stale.Info.Mounts = []dockerclient.MountPoint{{Name: "data"}}
+	assert.NoError(t, engine.AddContainer(stale))
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "live"}, Engine: engine}))
+
+	// Nothing is inspected.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "live"}}, nil).Once()
+	assert.NoError(t, engine.EvictStaleContainers())
+	assert.Nil(t, engine.ContainerByID("stale"))
+	assert.NotNil(t, engine.ContainerByID("live"))
+	assert.Empty(t, engine.ContainersUsingVolume("data"))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestContainersCreatedSince(t *testing.T) {
+	engine := NewEngine("test", 0)
+	now := time.Now()
+	for id, created := range map[string]time.Time{
+		"old":    now.Add(-48 * time.Hour),
+		"hour":   now.Add(-time.Hour),
+		"recent": now.Add(-time.Minute),
+	} {
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: id, Created: created.Unix()}, Engine: engine}))
+	}
+
+	assert.Len(t, engine.ContainersCreatedSince(now.Add(-72*time.Hour)), 3)
+	assert.Len(t, engine.ContainersCreatedSince(now.Add(-time.Hour)), 2)
+	containers := engine.ContainersCreatedSince(now.Add(-30 * time.Minute))
+	assert.Len(t, containers, 1)
+	assert.Equal(t, containers[0].Id, "recent")
+	assert.Empty(t, engine.ContainersCreatedSince(now.Add(time.Minute)))
+}
+
+func TestContainersByLabelSelector(t *testing.T) {
+	engine := NewEngine("test", 0)
+	for id, labels := range map[string]map[string]string{
+		"web1": {"app": "web", "tier": "front"},
+		"web2": {"app": "web", "tier": "back"},
+		"db":   {"app": "db", "tier": "back"},
+	} {
+		c := &Container{Container: dockerclient.Container{Id: id}, Engine: engine}
+		c.Info.Config = &dockerclient.ContainerConfig{Labels: labels}
+		assert.NoError(t, engine.AddContainer(c))
+	}
+	// Containers without a config have no labels.
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "bare"}, Engine: engine}))
+
+	ids := func(containers []*Container) []string {
+		ids := []string{}
+		for _, c := range containers {
+			ids = append(ids, c.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	assert.Equal(t, ids(engine.ContainersByLabelSelector(map[string]string{"app": "web"})), []string{"web1", "web2"})
+	assert.Equal(t, ids(engine.ContainersByLabelSelector(map[string]string{"tier": "back"})), []string{"db", "web2"})
+	assert.Equal(t, ids(engine.ContainersByLabelSelector(map[string]string{"app": "web", "tier": "back"})), []string{"web2"})
+	assert.Empty(t, engine.ContainersByLabelSelector(map[string]string{"app": "db", "tier": "front"}))
+	assert.Empty(t, engine.ContainersByLabelSelector(map[string]string{"app": "web", "missing": ""}))
+	// An empty selector matches every container.
+	assert.Len(t, engine.ContainersByLabelSelector(nil), 4)
+
+	value, exists := engine.Container("web1").Label("tier")
+	assert.True(t, exists)
+	assert.Equal(t, value, "front")
+	_, exists = engine.Container("web1").Label("missing")
+	assert.False(t, exists)
+	_, exists = engine.Container("bare").Label("app")
+	assert.False(t, exists)
+}
+
+func TestStats(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	// Each stream has its own request.
+	reader1, writer1 := io.Pipe()
+	reader2, writer2 := io.Pipe()
+	client.On("ContainerStats", "one").Return(reader1, nil).Once()
+	client.On("ContainerStats", "one").Return(reader2, nil).Once()
+	samples := make(chan *dockerclient.Stats, 10)
+	stop1, err := engine.Stats(container, func(stats *dockerclient.Stats) { samples <- stats })
+	assert.NoError(t, err)
+	stop2, err := engine.Stats(container, func(*dockerclient.Stats) {})
+	assert.NoError(t, err)
+
+	_, err = io.WriteString(writer1, `{"memory_stats":{"usage":10}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, (<-samples).MemoryStats.Usage, uint64(10))
+
+	// Stopping the first stream closes its request only.
+	stop1()
+	stop1()
+	_, err = io.WriteString(writer1, `{}`)
+	assert.Error(t, err)
+	_, err = io.WriteString(writer2, `{}`)
+	assert.NoError(t, err)
+	stop2()
+	assert.Len(t, samples, 0)
+
+	_, err = engine.Stats(&Container{Engine: engine}, func(*dockerclient.Stats) {})
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestDrainContainers(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	for _, id := range []string{"one", "two", "three"} {
+		container := &Container{Container: dockerclient.Container{Id: id}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, Engine: engine}
+		container.Info.State.Running = id != "three"
+		assert.NoError(t, engine.AddContainer(container))
+	}
+
+	// Stopping "one" fails, "two" must still be stopped and "three" is not running.
+	client.On("StopContainer", "one", 5).Return(errors.New("fail")).Once()
+	client.On("StopContainer", "two", 5).Return(nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "two")).Return([]dockerclient.Container{{Id: "two"}}, nil).Once()
+	client.On("InspectContainer", "two").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+
+	errs := engine.DrainContainers(5)
+	assert.Len(t, errs, 1)
+	assert.True(t, engine.Container("one").Info.State.Running)
+	assert.False(t, engine.Container("two").Info.State.Running)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestStopAndRemoveByLabel(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	for id, app := range map[string]string{"web1": "web", "web2": "web", "web3": "web", "db": "db"} {
+		container := &Container{Container: dockerclient.Container{Id: id}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{Labels: map[string]string{"app": app}}}, Engine: engine}
+		container.Info.State.Running = id != "web2"
+		assert.NoError(t, engine.AddContainer(container))
+	}
+
+	// "web2" is not running, "web3" fails to stop and is kept, "db" is left
+	// alone.
+	client.On("StopContainer", "web1", 10).Return(nil).Once()
+	client.On("StopContainer", "web3", 10).Return(errors.New("fail")).Once()
+	client.On("RemoveContainer", "web1", false, false).Return(nil).Once()
+	client.On("RemoveContainer", "web2", false, false).Return(nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "web3"}, {Id: "db"}}, nil).Once()
+
+	errs := engine.StopAndRemoveByLabel("app", "web", 10, false)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "web3")
+	assert.Nil(t, engine.Container("web1"))
+	assert.Nil(t, engine.Container("web2"))
+	assert.NotNil(t, engine.Container("web3"))
+	assert.NotNil(t, engine.Container("db"))
+
+	// With force, containers failing to stop are removed anyway.
+	client.On("StopContainer", "web3", 10).Return(errors.New("fail")).Once()
+	client.On("RemoveContainer", "web3", true, false).Return(nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "db"}}, nil).Once()
+	errs = engine.StopAndRemoveByLabel("app", "web", 10, true)
+	assert.Len(t, errs, 1)
+	assert.Len(t, engine.Containers(), 1)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	assert.NoError(t, retry(3, time.Millisecond, func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("busy")
+		}
+		return nil
+	}))
+	assert.Equal(t, calls, 2)
+
+	calls = 0
+	assert.EqualError(t, retry(3, time.Millisecond, func() error {
+		calls++
+		return errors.New("busy")
+	}), "busy")
+	assert.Equal(t, calls, 3)
+
+	// Missing objects won't show up by retrying.
+	calls = 0
+	assert.Equal(t, retry(3, time.Millisecond, func() error {
+		calls++
+		return dockerclient.ErrNotFound
+	}), dockerclient.ErrNotFound)
+	assert.Equal(t, calls, 1)
+}
+
+func TestRefreshContainersRetries(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	engine.SetClientRetries(2, time.Millisecond)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	// The second attempt of the listing and of the inspect succeed.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("busy")).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{}, errors.New("busy")).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	assert.NoError(t, engine.refreshContainers(true))
+	assert.NotNil(t, engine.Container("one"))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRefreshContainersInspectFailure(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one"}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{Memory: 10}}, Engine: engine}))
+
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}, {Id: "two"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{}, errors.New("fail")).Once()
+	client.On("InspectContainer", "two").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+
+	// The failed inspect must not drop the known container.
+	assert.NoError(t, engine.refreshContainers(true))
+	assert.Len(t, engine.Containers(), 2)
+	assert.Equal(t, engine.Container("one").Info.Config.Memory, 10)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRegisterEventHandlerFiltered(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandlerFiltered(handler, "die"))
+	assert.Error(t, engine.RegisterEventHandler(handler))
+
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Twice()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Twice()
+
+	engine.handler(&dockerclient.Event{Id: "one", Status: "start"}, nil)
+	engine.handler(&dockerclient.Event{Id: "one", Status: "die"}, nil)
+	assert.Equal(t, handler.statuses(), []string{"die"})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestOOMAndRestartEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	// Both events trigger an inspect of the container.
+	oomKilled := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	oomKilled.State.OOMKilled = true
+	oomKilled.State.ExitCode = 137
+	oomKilled.State.StartedAt = time.Unix(1, 0)
+	restarted := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	restarted.State.Running = true
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Twice()
+	client.On("InspectContainer", "one").Return(oomKilled, nil).Once()
+	client.On("InspectContainer", "one").Return(restarted, nil).Once()
+
+	engine.handler(&dockerclient.Event{Id: "one", Status: "oom", TimeNano: 100}, nil)
+	container := engine.Container("one")
+	assert.True(t, container.WasOOMKilled())
+	code, exited := engine.ExitCode(container)
+	assert.True(t, exited)
+	assert.Equal(t, code, 137)
+
+	engine.handler(&dockerclient.Event{Id: "one", Status: "restart", TimeNano: 200}, nil)
+	container = engine.Container("one")
+	assert.False(t, container.WasOOMKilled())
+	assert.Equal(t, container.State(), StateRunning)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPauseEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	// Nothing is refreshed while paused, the mock would panic otherwise.
+	engine.PauseEvents()
+	engine.PauseEvents()
+	engine.handler(&dockerclient.Event{Id: "one", Status: "create", TimeNano: 100}, nil)
+	engine.handler(&dockerclient.Event{Id: "one", Status: "start", TimeNano: 200}, nil)
+	engine.handler(&dockerclient.Event{Id: "two", Status: "destroy", TimeNano: 300}, nil)
+	engine.handler(&dockerclient.Event{Id: "busybox", Status: "pull", TimeNano: 400}, nil)
+	assert.Equal(t, handler.statuses(), []string{"create", "start", "destroy", "pull"})
+	assert.NoError(t, engine.ResumeEvents())
+
+	// The last resume catches up at once.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "busybox"}}, nil).Once()
+	assert.NoError(t, engine.ResumeEvents())
+	assert.NotNil(t, engine.Container("one"))
+	assert.NotNil(t, engine.Image("busybox"))
+
+	// Unbalanced resumes are refused, and don't undo the next pause.
+	assert.Equal(t, engine.ResumeEvents(), ErrEventsNotPaused)
+	engine.PauseEvents()
+	engine.handler(&dockerclient.Event{Id: "two", Status: "create", TimeNano: 450}, nil)
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "busybox"}}, nil).Once()
+	assert.NoError(t, engine.ResumeEvents())
+
+	// Events refresh the state again.
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "one", Status: "die", TimeNano: 500}, nil)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestEventCarriesEngineIdentity(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.ID = "engine-id"
+	engine.Name = "engine-name"
+	engine.IP = "10.0.0.1"
+	engine.Labels = map[string]string{"foo": "bar"}
+
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+	engine.emitEvent("engine_connect")
+	assert.Len(t, handler.events, 1)
+
+	// The engine identity survives serialization.
+	data, err := json.Marshal(handler.events[0])
+	assert.NoError(t, err)
+	var ev struct {
+		Status string
+		Node   map[string]interface{}
+	}
+	assert.NoError(t, json.Unmarshal(data, &ev))
+	assert.Equal(t, ev.Status, "engine_connect")
+	assert.Equal(t, ev.Node["Id"], "engine-id")
+	assert.Equal(t, ev.Node["Name"], "engine-name")
+	assert.Equal(t, ev.Node["Ip"], "10.0.0.1")
+	assert.Equal(t, ev.Node["Addr"], "test")
+	assert.Equal(t, ev.Node["Labels"], map[string]interface{}{"foo": "bar"})
+}
+
+func TestRestartCount(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil)
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil)
+
+	for i := 0; i < 3; i++ {
+		engine.handler(&dockerclient.Event{Id: "one", Status: "start"}, nil)
+		engine.handler(&dockerclient.Event{Id: "one", Status: "die"}, nil)
+	}
+	container := engine.ContainerByID("one")
+	assert.NotNil(t, container)
+	assert.Equal(t, engine.RestartCount(container), 3)
+
+	// The count goes away with the container.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	assert.NoError(t, engine.refreshContainers(false))
+	assert.Equal(t, engine.RestartCount(container), 0)
+}
+
+func TestSlowPullDoesNotTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { connectTimeout = timeout }(connectTimeout)
+	connectTimeout = 50 * time.Millisecond
+
+	// The daemon takes longer than the connect timeout to complete the pull.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(4 * connectTimeout)
+		fmt.Fprint(w, `{"status":"Download complete"}`)
+	}))
+	defer server.Close()
+
+	client, err := newClient(strings.TrimPrefix(server.URL, "http://"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, client.PullImage("busybox:latest", nil))
+}
+
+func TestDuplicateEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil)
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil)
+
+	for _, ev := range []*dockerclient.Event{
+		{Id: "one", Status: "start", TimeNano: 100},
+		{Id: "one", Status: "die", TimeNano: 200},
+		{Id: "one", Status: "start", TimeNano: 300},
+		// Replayed and stale events.
+		{Id: "one", Status: "start", TimeNano: 300},
+		{Id: "one", Status: "die", TimeNano: 200},
+		// Distinct events sharing a timestamp.
+		{Id: "one", Status: "attach", Time: 1},
+		{Id: "one", Status: "create", Time: 1},
+		{Id: "one", Status: "create", Time: 1},
+	} {
+		engine.handler(ev, nil)
+	}
+
+	// Every event was processed once, in order.
+	assert.Equal(t, handler.statuses(), []string{"start", "die", "start", "attach", "create"})
+	assert.Equal(t, engine.RestartCount(engine.ContainerByID("one")), 1)
+	client.Mock.AssertNumberOfCalls(t, "InspectContainer", 3)
+}
+
+func TestHealthStatusEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	healthy := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	healthy.State.Health = &dockerclient.Health{Status: "healthy"}
+	unhealthy := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	unhealthy.State.Health = &dockerclient.Health{Status: "unhealthy", FailingStreak: 3}
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil)
+	client.On("InspectContainer", "one").Return(healthy, nil).Once()
+	client.On("InspectContainer", "one").Return(unhealthy, nil).Once()
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "two"}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, Engine: engine}))
+
+	// Health events trigger an inspect to pick up the new status.
+	engine.handler(&dockerclient.Event{Id: "one", Status: "health_status: healthy"}, nil)
+	assert.Equal(t, engine.ContainerByID("one").Health(), "healthy")
+	assert.Len(t, engine.ContainersByHealth("healthy"), 1)
+
+	engine.handler(&dockerclient.Event{Id: "one", Status: "health_status: unhealthy"}, nil)
+	assert.Equal(t, engine.ContainerByID("one").Health(), "unhealthy")
+	assert.Empty(t, engine.ContainersByHealth("healthy"))
+	assert.Len(t, engine.ContainersByHealth("unhealthy"), 1)
+
+	// Containers without health check have no status.
+	assert.Equal(t, engine.ContainerByID("two").Health(), "")
+	assert.Len(t, engine.ContainersByHealth(""), 1)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestSubscribe(t *testing.T) {
+	engine := NewEngine("test", 0)
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	events, unsubscribe := engine.Subscribe()
+	engine.emitEvent("engine_connect")
+	ev := <-events
+	assert.Equal(t, ev.Status, "engine_connect")
+	assert.Equal(t, ev.Engine, engine)
+	// The event handler still gets the events.
+	assert.Equal(t, handler.statuses(), []string{"engine_connect"})
+
+	// A full channel doesn't block the engine.
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		engine.emitEvent("engine_reconnect")
+	}
+	assert.Len(t, events, subscriptionBuffer)
+
+	// Unsubscribing closes the channel once drained, no more events are sent.
+	unsubscribe()
+	unsubscribe()
+	engine.emitEvent("engine_disconnect")
+	for ev := range events {
+		assert.Equal(t, ev.Status, "engine_reconnect")
+	}
+}
+
+func TestRegisterEventHandlerConcurrently(t *testing.T) {
+	engine := NewEngine("test", 0)
+	handler := &recordingHandler{}
+
+	// Run with -race to catch unprotected accesses.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			engine.emitEvent("engine_connect")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			engine.RegisterEventHandler(handler)
+			engine.UnregisterEventHandler()
+		}
+	}()
+	wg.Wait()
+
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+	engine.emitEvent("engine_connect")
+	events := len(handler.statuses())
+	engine.UnregisterEventHandler()
+	engine.emitEvent("engine_connect")
+	assert.Len(t, handler.statuses(), events)
+}
+
+// blockingPullClient holds every PullImage call until released.
+type blockingPullClient struct {
+	*mockclient.MockClient
+	release chan struct{}
+}
+
+func (c *blockingPullClient) PullImage(name string, auth *dockerclient.AuthConfig) error {
+	<-c.release
+	return c.MockClient.PullImage(name, auth)
+}
+
+// blockingCreateClient holds every CreateContainer call until released.
+type blockingCreateClient struct {
+	*mockclient.MockClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCreateClient) CreateContainer(config *dockerclient.ContainerConfig, name string) (string, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return c.MockClient.CreateContainer(config, name)
+}
+
+func TestShutdown(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := &blockingCreateClient{mockclient.NewMockClient(), make(chan struct{}), make(chan struct{})}
+	client.On("Info").Return(mockInfo, nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	assert.NoError(t, engine.connectClient(client))
+
+	// A slow creation is in flight.
+	client.On("CreateContainer", mock.Anything, "slow").Return("id", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "id")).Return([]dockerclient.Container{{Id: "id"}}, nil).Once()
+	client.On("InspectContainer", "id").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	created := make(chan error)
+	go func() {
+		_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "slow", false)
+		created <- err
+	}()
+	<-client.started
+
+	// Shutdown doesn't return before it completes.
+	assert.Error(t, engine.Shutdown(10*time.Millisecond))
+	assert.True(t, engine.isConnected())
+
+	// New operations are refused in the meantime.
+	_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "new", false)
+	assert.Equal(t, err, ErrShutdown)
+	assert.Equal(t, engine.Pull("busybox"), ErrShutdown)
+	assert.Equal(t, engine.DrainContainers(10), []error{ErrShutdown})
+
+	client.On("StopAllMonitorEvents").Return().Once()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(client.release)
+	}()
+	assert.NoError(t, engine.Shutdown(time.Second))
+	assert.NoError(t, <-created)
+	assert.False(t, engine.isConnected())
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPullCoalesces(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := &blockingPullClient{mockclient.NewMockClient(), make(chan struct{})}
+	engine.client = client
+
+	client.On("PullImage", "busybox:latest", mock.Anything).Return(nil)
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil)
+
+	assert.False(t, engine.IsPulling("busybox"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, engine.Pull("busybox"))
+		}()
+	}
+	// Give every pull the time to queue up behind the first one.
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, engine.IsPulling("busybox"))
+	assert.True(t, engine.IsPulling("busybox:latest"))
+	close(client.release)
+	wg.Wait()
+
+	assert.False(t, engine.IsPulling("busybox"))
+	client.Mock.AssertNumberOfCalls(t, "PullImage", 1)
+	client.Mock.AssertNumberOfCalls(t, "ListImages", 1)
+}
+
+func TestCpusChangeAfterCreate(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.Cpus = 4
+	engine.images = []*Image{{Image: dockerclient.Image{Id: "busybox", RepoTags: []string{"busybox:latest"}}, Engine: engine}}
+
+	// What the engine reports about the created container.
+	inspected := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{CpuShares: 512, Labels: map[string]string{CpusLabel: "4"}}}
+	inspected.State.Running = true
+
+	client.On("CreateContainer", mock.Anything, "").Return("one", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Twice()
+	client.On("InspectContainer", "one").Return(inspected, nil).Twice()
+	container, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox", CpuShares: 2}, "", false)
+	assert.NoError(t, err)
+
+	// The shares are scaled by the CPUs the engine had at create.
+	created := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, created.CpuShares, 512)
+	assert.Equal(t, created.Labels[CpusLabel], "4")
+
+	// The accounting is the same once the number of CPUs changes.
+	used := engine.UsedCpus()
+	engine.Cpus = 8
+	assert.NoError(t, engine.refreshContainer(container.Id, true))
+	assert.Equal(t, engine.UsedCpus(), used)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestMemorySwap(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	info := *mockInfo
+	info.Labels = []string{"swap=1000"}
+	client.On("Info").Return(&info, nil).Once()
+	assert.NoError(t, engine.updateSpecs())
+
+	// Without swap limit support, there is no swap to account.
+	assert.Equal(t, engine.TotalMemorySwap(), 0)
+	info.SwapLimit = true
+	client.On("Info").Return(&info, nil).Once()
+	assert.NoError(t, engine.updateSpecs())
+	assert.Equal(t, engine.TotalMemorySwap(), 1020)
+
+	for id, swap := range map[string]int64{"limited": 300, "default": 0, "unlimited": -1} {
+		config := &dockerclient.ContainerConfig{Memory: 10, MemorySwap: swap}
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: id}, Info: runningInfo(config), Engine: engine}))
+	}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "exited"}, Info: exitedInfo(&dockerclient.ContainerConfig{Memory: 10, MemorySwap: 100}), Engine: engine}))
+	assert.Equal(t, engine.Container("limited").ReservedMemorySwap(), 300)
+	assert.Equal(t, engine.Container("default").ReservedMemorySwap(), 20)
+	assert.Equal(t, engine.Container("unlimited").ReservedMemorySwap(), 10)
+	assert.Equal(t, engine.UsedMemorySwap(), 330)
+
+	// The memory reserved is what counts, whatever the swap limit.
+	for swap, reserved := range map[int64]int64{300: 294, 0: 8, -1: 4} {
+		labels := map[string]string{MemoryReservationLabel: "4"}
+		container := &Container{Info: runningInfo(&dockerclient.ContainerConfig{Memory: 10, MemorySwap: swap, Labels: labels})}
+		assert.Equal(t, container.ReservedMemorySwap(), reserved)
+	}
+
+	// The swap limit is passed through at create.
+	client.On("CreateContainer", mock.Anything, "").Return("one", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox", Memory: 10, MemorySwap: -1}, "", false)
+	assert.NoError(t, err)
+	created := client.Mock.Calls[2].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Equal(t, created.MemorySwap, -1)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestUsedResourcesStoppedContainers(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = 4
+	engine.Memory = 1024
+
+	config := &dockerclient.ContainerConfig{Memory: 100, CpuShares: 1}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "running"}, Info: runningInfo(config), Engine: engine}))
+	paused := &Container{Container: dockerclient.Container{Id: "paused"}, Info: runningInfo(config), Engine: engine}
+	paused.Info.State.Paused = true
+	assert.NoError(t, engine.AddContainer(paused))
+	restarting := &Container{Container: dockerclient.Container{Id: "restarting"}, Info: dockerclient.ContainerInfo{Config: config}, Engine: engine}
+	restarting.Info.State.Restarting = true
+	assert.NoError(t, engine.AddContainer(restarting))
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "exited"}, Info: exitedInfo(config), Engine: engine}))
+
+	// Exited containers reserve nothing by default, containers created but
+	// not started yet do.
+	assert.Equal(t, engine.UsedMemory(), 300)
+	assert.Equal(t, engine.UsedCpus(), 3)
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "created"}, Info: dockerclient.ContainerInfo{Config: config}, Engine: engine}))
+	assert.Equal(t, engine.UsedMemory(), 400)
+	assert.Equal(t, engine.UsedCpus(), 4)
+	assert.Equal(t, engine.Capacity().UsedMemory, 400)
+	assert.Equal(t, engine.Capacity().UsedCpus, 4)
+
+	engine.SetReserveStopped(true)
+	assert.Equal(t, engine.UsedMemory(), 500)
+	assert.Equal(t, engine.UsedCpus(), 5)
+	assert.Equal(t, engine.Capacity().UsedMemory, 500)
+	assert.Equal(t, engine.Capacity().UsedCpus, 5)
+}
+
+func TestOvercommit(t *testing.T) {
+	engine := NewEngine("test", 0.5)
+	engine.Cpus = 2
+	engine.Memory = 1024
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	config := &dockerclient.ContainerConfig{Memory: 1000, CpuShares: 1}
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one"}, Info: runningInfo(config), Engine: engine}))
+	memOver, cpuOver := engine.IsOvercommitted()
+	assert.False(t, memOver)
+	assert.False(t, cpuOver)
+	assert.Empty(t, handler.statuses())
+
+	// Past the total + overcommit of the memory only.
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "two"}, Info: runningInfo(config), Engine: engine}))
+	memOver, cpuOver = engine.IsOvercommitted()
+	assert.True(t, memOver)
+	assert.False(t, cpuOver)
+	assert.Equal(t, handler.statuses(), []string{"engine_overcommitted"})
+
+	// The event is only emitted when crossing the threshold.
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "three"}, Info: runningInfo(config), Engine: engine}))
+	memOver, cpuOver = engine.IsOvercommitted()
+	assert.True(t, memOver)
+	assert.False(t, cpuOver)
+	assert.Equal(t, handler.statuses(), []string{"engine_overcommitted"})
+
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "four"}, Info: runningInfo(config), Engine: engine}))
+	memOver, cpuOver = engine.IsOvercommitted()
+	assert.True(t, memOver)
+	assert.True(t, cpuOver)
+	assert.Len(t, handler.statuses(), 1)
+}
+
+func TestReserve(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = 10
+	engine.Memory = 1000
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one"}, Info: runningInfo(&dockerclient.ContainerConfig{Memory: 200, CpuShares: 2}), Engine: engine}))
+
+	// Concurrent schedulers never get more than the engine has.
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		releases []func()
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, ok := engine.Reserve(1, 100); ok {
+				lock.Lock()
+				releases = append(releases, release)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, releases, 8)
+	assert.Equal(t, engine.UsedCpus(), 10)
+	assert.Equal(t, engine.UsedMemory(), 1000)
+	assert.Equal(t, engine.Capacity().UsedMemory, 1000)
+	_, ok := engine.Reserve(0, 1)
+	assert.False(t, ok)
+
+	// Releasing twice is harmless.
+	releases[0]()
+	releases[0]()
+	assert.Equal(t, engine.UsedCpus(), 9)
+	for _, release := range releases[1:] {
+		release()
+	}
+	assert.Equal(t, engine.UsedCpus(), 2)
+	assert.Equal(t, engine.UsedMemory(), 200)
+}
+
+func TestScore(t *testing.T) {
+	newEngine := func(usedCpus, usedMemory int64) *Engine {
+		engine := NewEngine("test", 0)
+		engine.Cpus = 4
+		engine.Memory = 1000
+		config := &dockerclient.ContainerConfig{CpuShares: usedCpus, Memory: usedMemory}
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one"}, Info: runningInfo(config), Engine: engine}))
+		return engine
+	}
+	full, empty := newEngine(2, 500), newEngine(0, 0)
+	config := &dockerclient.ContainerConfig{CpuShares: 1, Memory: 250}
+
+	// Binpack prefers the fuller engine.
+	score, err := full.Score(config, "binpack")
+	assert.NoError(t, err)
+	assert.Equal(t, score, 150)
+	score, err = empty.Score(config, "binpack")
+	assert.NoError(t, err)
+	assert.Equal(t, score, 50)
+
+	// Spread prefers the emptier one.
+	score, err = full.Score(config, "spread")
+	assert.NoError(t, err)
+	assert.Equal(t, score, 50)
+	score, err = empty.Score(config, "spread")
+	assert.NoError(t, err)
+	assert.Equal(t, score, 150)
+
+	// Containers which don't fit can't be scored.
+	_, err = full.Score(&dockerclient.ContainerConfig{CpuShares: 1, Memory: 600}, "binpack")
+	assert.Equal(t, err, ErrNoFit)
+	_, err = full.Score(&dockerclient.ContainerConfig{CpuShares: 3}, "spread")
+	assert.Equal(t, err, ErrNoFit)
+
+	_, err = empty.Score(config, "random")
+	assert.Error(t, err)
+}
+
+func TestCapacity(t *testing.T) {
+	engine := NewEngine("test", 0.5)
+	engine.Cpus = 4
+	engine.Memory = 1024
+
+	for i, id := range []string{"one", "two"} {
+		config := &dockerclient.ContainerConfig{Memory: int64(100 * (i + 1)), CpuShares: int64(i + 1)}
+		assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: id}, Info: runningInfo(config), Engine: engine}))
+	}
+
+	capacity := engine.Capacity()
+	assert.Equal(t, capacity, EngineCapacity{
+		TotalCpus:      engine.TotalCpus(),
+		UsedCpus:       engine.UsedCpus(),
+		TotalMemory:    engine.TotalMemory(),
+		UsedMemory:     engine.UsedMemory(),
+		ContainerCount: 2,
+	})
+	assert.Equal(t, capacity.UsedCpus, 3)
+	assert.Equal(t, capacity.UsedMemory, 300)
+	assert.Equal(t, capacity.TotalCpus, 6)
+	assert.Equal(t, capacity.TotalMemory, 1536)
+}
+
+func TestConnectStoresTLSConfig(t *testing.T) {
+	var used *tls.Config
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		used = config
+		return nil, errors.New("fail")
+	}
+
+	config := &tls.Config{ServerName: "engine"}
+	engine := NewEngine("127.0.0.1:2375", 0)
+	assert.Error(t, engine.Connect(config))
+	assert.Equal(t, used, config)
+	assert.Equal(t, engine.tlsConfig, config)
+}
+
+func TestConnectTwice(t *testing.T) {
+	engine := NewEngine("127.0.0.1:2375", 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	created := 0
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		created++
+		return client, nil
+	}
+
+	assert.NoError(t, engine.Connect(nil))
+	assert.Equal(t, engine.Connect(nil), ErrAlreadyConnected)
+	assert.Equal(t, engine.connectClient(mockclient.NewMockClient()), ErrAlreadyConnected)
+
+	// Only one client, refresh loop and event monitor were started.
+	assert.Equal(t, created, 1)
+	client.Mock.AssertNumberOfCalls(t, "StartMonitorEvents", 1)
+	client.Mock.AssertExpectations(t)
+}
+
+// blockingInfoClient holds every Info call until released.
+type blockingInfoClient struct {
+	*mockclient.MockClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingInfoClient) Info() (*dockerclient.Info, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return c.MockClient.Info()
+}
+
+func TestConnectConcurrently(t *testing.T) {
+	engine := NewEngine("127.0.0.1:2375", 0)
+	client := &blockingInfoClient{mockclient.NewMockClient(), make(chan struct{}), make(chan struct{})}
+	client.On("Info").Return(mockInfo, nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	var created int32
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		atomic.AddInt32(&created, 1)
+		return client, nil
+	}
+
+	// Both connections are attempted while the first one is held.
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- engine.Connect(nil)
+		}()
+	}
+	<-client.started
+	close(client.release)
+	errs := []error{<-results, <-results}
+	assert.Contains(t, errs, nil)
+	assert.Contains(t, errs, ErrAlreadyConnected)
+	assert.Equal(t, atomic.LoadInt32(&created), 1)
+
+	// Connecting the client directly is refused too while a connection is
+	// in progress.
+	other := &blockingInfoClient{mockclient.NewMockClient(), make(chan struct{}), make(chan struct{})}
+	other.On("Info").Return(mockInfo, nil).Once()
+	other.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	abandoned := NewEngine("test", 0)
+	abandoned.SetClientRetries(1, 0)
+	done := make(chan error)
+	go func() {
+		done <- abandoned.connectClient(other)
+	}()
+	<-other.started
+	assert.Equal(t, abandoned.connectClient(mockclient.NewMockClient()), ErrAlreadyConnected)
+	close(other.release)
+	assert.Error(t, <-done)
+
+	client.Mock.AssertNumberOfCalls(t, "StartMonitorEvents", 1)
+	client.Mock.AssertExpectations(t)
+	other.Mock.AssertExpectations(t)
+}
+
+func TestImageRefreshDisabled(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.SetImageRefreshEnabled(false)
+
+	// The periodic refresh leaves the images alone.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	assert.NoError(t, engine.refresh())
+	client.Mock.AssertNotCalled(t, "ListImages")
+
+	// Image events still refresh them.
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "image-id"}}, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "busybox", Status: "pull"}, nil)
+	assert.Len(t, engine.Images(), 1)
+
+	engine.SetImageRefreshEnabled(true)
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "image-id"}}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	assert.NoError(t, engine.refresh())
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestReconnectRecreatesClient(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	engine.tlsConfig = &tls.Config{ServerName: "engine"}
+	dead := mockclient.NewMockClient()
+	dead.On("Info").Return(mockInfo, nil)
+	dead.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return()
+	dead.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	dead.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	assert.NoError(t, engine.connectClient(dead))
+
+	// The engine dies.
+	dead.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	engine.refresh()
+	assert.False(t, engine.IsHealthy())
+
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+
+	// Rebuilding the client fails, the engine stays unhealthy.
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return nil, errors.New("fail")
+	}
+	engine.refresh()
+	assert.False(t, engine.IsHealthy())
+	assert.Equal(t, engine.client, dead)
+
+	// The engine comes back with a fresh client built from the stored config.
+	fresh := mockclient.NewMockClient()
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		assert.Equal(t, addr, engine.Addr)
+		assert.Equal(t, config, engine.tlsConfig)
+		return fresh, nil
+	}
+	dead.On("StopAllMonitorEvents").Return().Once()
+	fresh.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	fresh.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	fresh.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	fresh.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	fresh.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	fresh.On("Info").Return(mockInfo, nil).Twice()
+	engine.refresh()
+	assert.True(t, engine.IsHealthy())
+	assert.Equal(t, engine.client, fresh)
+
+	dead.Mock.AssertExpectations(t)
+	fresh.Mock.AssertExpectations(t)
+}
+
+func TestReconnectConcurrentReads(t *testing.T) {
+	engine := NewEngine("test", 0)
+	dead := mockclient.NewMockClient()
+	dead.On("StopAllMonitorEvents").Return()
+	engine.client = dead
+
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	fresh := mockclient.NewMockClient()
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return fresh, nil
+	}
+
+	// The client is swapped while API calls read it.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			assert.True(t, engine.isConnected())
+		}
+		close(done)
+	}()
+	assert.NoError(t, engine.reconnectClient())
+	<-done
+
+	client, err := engine.clientOrErr()
+	assert.NoError(t, err)
+	assert.Equal(t, client, fresh)
+}
+
+func TestReconnectIdentityChanged(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil).Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	assert.NoError(t, engine.connectClient(client))
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	// The engine dies.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	engine.refresh()
+	assert.False(t, engine.IsHealthy())
+
+	// Another host answers at the same address, it is not adopted.
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	other := mockclient.NewMockClient()
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return other, nil
+	}
+	info := *mockInfo
+	info.ID = "other"
+	other.On("Info").Return(&info, nil).Once()
+	assert.Error(t, engine.refresh())
+	assert.False(t, engine.IsHealthy())
+	assert.Equal(t, engine.ID, mockInfo.ID)
+
+	// Its client is never installed, the previous one is kept.
+	current, err := engine.clientOrErr()
+	assert.NoError(t, err)
+	assert.Equal(t, current, client)
+	assert.True(t, current != other)
+	assert.Equal(t, handler.statuses(), []string{"engine_disconnect", "engine_mismatch"})
+
+	client.Mock.AssertExpectations(t)
+	other.Mock.AssertExpectations(t)
+}
+
+func TestReconnectResumesEvents(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	assert.NoError(t, engine.connectClient(client))
+
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "image", Status: "pull", Time: 1000}, nil)
+
+	// The engine dies.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	engine.refresh()
+	assert.False(t, engine.IsHealthy())
+
+	// It comes back, events are monitored from the last one seen.
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return client, nil
+	}
+	client.On("StopAllMonitorEvents").Return().Once()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	client.On("StartMonitorEventsSince", int64(1000), mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	engine.refresh()
+	assert.True(t, engine.IsHealthy())
+
+	// The replayed window only brings the missed events.
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "image", Status: "pull", Time: 1000}, nil)
+	engine.handler(&dockerclient.Event{Id: "image", Status: "untag", Time: 1005}, nil)
+	assert.Equal(t, handler.statuses(), []string{"untag"})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestReconcileOnReconnect(t *testing.T) {
+	var (
+		intent  = &dockerclient.ContainerConfig{Labels: map[string]string{RestartLabel: "true"}}
+		running = &dockerclient.ContainerInfo{Config: intent}
+		dead    = &dockerclient.ContainerInfo{Config: intent}
+		engine  = NewEngine("test", 0)
+		client  = mockclient.NewMockClient()
+	)
+	running.State.Running = true
+	dead.State.StartedAt = time.Unix(1, 0)
+	engine.SetReconcileOnReconnect(true)
+	engine.SetClientRetries(1, 0)
+
+	listed := []dockerclient.Container{{Id: "intent"}, {Id: "other"}}
+	client.On("Info").Return(mockInfo, nil)
+	client.On("ListContainers", true, false, "").Return(listed, nil).Once()
+	client.On("InspectContainer", "intent").Return(running, nil).Once()
+	client.On("InspectContainer", "other").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	assert.NoError(t, engine.connectClient(client))
+
+	// The engine dies.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	engine.refresh()
+	assert.False(t, engine.IsHealthy())
+
+	// It comes back, the container died in the meantime and is restarted.
+	// The one without a restart intent is left alone.
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	newClient = func(addr string, config *tls.Config) (dockerclient.Client, error) {
+		return client, nil
+	}
+	filter := fmt.Sprintf(`{"id":[%q]}`, "intent")
+	client.On("StopAllMonitorEvents").Return().Once()
+	client.On("ListContainers", true, false, "").Return(listed, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return().Once()
+	client.On("ListContainers", true, false, filter).Return(listed[:1], nil).Twice()
+	client.On("InspectContainer", "intent").Return(dead, nil).Once()
+	client.On("StartContainer", "intent", (*dockerclient.HostConfig)(nil)).Return(nil).Once()
+	client.On("InspectContainer", "intent").Return(running, nil).Once()
+	engine.refresh()
+	assert.True(t, engine.IsHealthy())
+	assert.Equal(t, engine.ContainerByID("intent").State(), StateRunning)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestExitCode(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	running := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	running.State.Running = true
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "one")).Return([]dockerclient.Container{{Id: "one"}}, nil)
+	client.On("InspectContainer", "one").Return(running, nil).Once()
+	assert.NoError(t, engine.refreshContainer("one", true))
+	container := engine.ContainerByID("one")
+	_, known := engine.ExitCode(container)
+	assert.False(t, known)
+
+	// The container dies.
+	exited := &dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}
+	exited.State.ExitCode = 3
+	exited.State.StartedAt = time.Unix(1, 0)
+	client.On("InspectContainer", "one").Return(exited, nil).Once()
+	engine.handler(&dockerclient.Event{Id: "one", Status: "die"}, nil)
+	code, known := engine.ExitCode(container)
+	assert.True(t, known)
+	assert.Equal(t, code, 3)
+
+	// Unknown containers have no exit code.
+	_, known = engine.ExitCode(&Container{Container: dockerclient.Container{Id: "two"}, Engine: engine})
+	assert.False(t, known)
+
+	// Nor do containers which never ran.
+	created := &Container{Container: dockerclient.Container{Id: "created"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(created))
+	_, known = engine.ExitCode(created)
+	assert.False(t, known)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestContainersUsingVolume(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}, {Id: "two"}, {Id: "three"}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	data := dockerclient.MountPoint{Name: "data", Source: "/var/lib/docker/volumes/data/_data", Destination: "/data", Driver: "local"}
+	bind := dockerclient.MountPoint{Source: "/etc/app", Destination: "/etc/app"}
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}, Mounts: []dockerclient.MountPoint{data}}, nil).Once()
+	client.On("InspectContainer", "two").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}, Mounts: []dockerclient.MountPoint{data, bind}}, nil).Once()
+	client.On("InspectContainer", "three").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	assert.NoError(t, engine.connectClient(client))
+
+	assert.Equal(t, engine.ContainerVolumes(engine.ContainerByID("two")), []string{"data", "/etc/app"})
+	assert.Empty(t, engine.ContainerVolumes(engine.ContainerByID("three")))
+	assert.Len(t, engine.ContainersUsingVolume("data"), 2)
+	assert.Len(t, engine.ContainersUsingVolume("/etc/app"), 1)
+	assert.Empty(t, engine.ContainersUsingVolume("other"))
+
+	// The index follows the containers.
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "three")).Return([]dockerclient.Container{{Id: "three"}}, nil).Once()
+	client.On("InspectContainer", "three").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}, Mounts: []dockerclient.MountPoint{data}}, nil).Once()
+	assert.NoError(t, engine.refreshContainer("three", true))
+	assert.Len(t, engine.ContainersUsingVolume("data"), 3)
+
+	client.On("RemoveContainer", "two", false, true).Return(nil).Once()
+	assert.NoError(t, engine.Destroy(engine.ContainerByID("two"), false, true))
+	assert.Len(t, engine.ContainersUsingVolume("data"), 2)
+	assert.Empty(t, engine.ContainersUsingVolume("/etc/app"))
+
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	assert.NoError(t, engine.refreshContainers(false))
+	users := engine.ContainersUsingVolume("data")
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, users[0].Id, "one")
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestDanglingVolumes(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	container.Info.Mounts = []dockerclient.MountPoint{{Name: "data"}}
+	assert.NoError(t, engine.AddContainer(container))
+	client.On("ListVolumes").Return([]*dockerclient.Volume{{Name: "data"}, {Name: "orphan"}, {Name: "cache"}}, nil).Once()
+	assert.NoError(t, engine.RefreshVolumes())
+
+	assert.Equal(t, engine.DanglingVolumes(), []string{"cache", "orphan"})
+	for _, name := range engine.DanglingVolumes() {
+		assert.Empty(t, engine.ContainersUsingVolume(name))
+	}
+
+	client.On("RemoveVolume", "orphan", false).Return(nil).Once()
+	assert.NoError(t, engine.RemoveVolume("orphan", false))
+	assert.Nil(t, engine.Volume("orphan"))
+	assert.Equal(t, engine.DanglingVolumes(), []string{"cache"})
+
+	// Failed removals keep the volume.
+	client.On("RemoveVolume", "data", false).Return(errors.New("volume is in use")).Once()
+	assert.Error(t, engine.RemoveVolume("data", false))
+	assert.NotNil(t, engine.Volume("data"))
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestSwarmContainers(t *testing.T) {
+	var (
+		config = &dockerclient.ContainerConfig{
+			Image:  "busybox",
+			Labels: map[string]string{"foo": "bar"},
+		}
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.Cpus = mockInfo.NCPU
+	engine.client = client
+
+	// A container which was running before swarm.
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "foreign"}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, Engine: engine}))
+
+	client.On("CreateContainer", mock.Anything, "test").Return("id", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "id")).Return([]dockerclient.Container{{Id: "id"}}, nil).Once()
+	client.On("InspectContainer", "id").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{Labels: map[string]string{SwarmIDLabel: "swarm-id"}}}, nil).Once()
+	_, err := engine.Create(config, "test", false)
+	assert.NoError(t, err)
+
+	// The label is stamped on the config sent to the engine only.
+	created := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig)
+	assert.Len(t, created.Labels[SwarmIDLabel], 64)
+	assert.Equal(t, created.Labels["foo"], "bar")
+	assert.Len(t, config.Labels, 1)
+
+	assert.Len(t, engine.Containers(), 2)
+	containers := engine.SwarmContainers()
+	assert.Len(t, containers, 1)
+	assert.Equal(t, containers[0].Id, "id")
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestCreateContainerSwarmID(t *testing.T) {
+	var (
+		engine = NewEngine("test", 0)
+		client = mockclient.NewMockClient()
+	)
+	engine.Cpus = mockInfo.NCPU
+	engine.client = client
+
+	client.On("CreateContainer", mock.Anything, mock.Anything).Return("id1", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "id1")).Return([]dockerclient.Container{{Id: "id1"}}, nil).Once()
+	client.On("InspectContainer", "id1").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	_, err := engine.Create(&dockerclient.ContainerConfig{Image: "busybox"}, "test1", false)
+	assert.NoError(t, err)
+	first := client.Mock.Calls[0].Arguments.Get(0).(*dockerclient.ContainerConfig).Labels[SwarmIDLabel]
+
+	// Every container gets its own ID and user labels are preserved.
+	config := &dockerclient.ContainerConfig{Image: "busybox", Labels: map[string]string{"foo": "bar"}}
+	client.On("CreateContainer", mock.Anything, mock.Anything).Return("id2", nil).Once()
+	client.On("ListContainers", true, false, fmt.Sprintf(`{"id":[%q]}`, "id2")).Return([]dockerclient.Container{{Id: "id2"}}, nil).Once()
+	client.On("InspectContainer", "id2").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{Labels: map[string]string{"foo": "bar", SwarmIDLabel: "swarm-id"}}}, nil).Once()
+	container, err := engine.Create(config, "test2", false)
+	assert.NoError(t, err)
+	labels := client.Mock.Calls[3].Arguments.Get(0).(*dockerclient.ContainerConfig).Labels
+	assert.NotEqual(t, labels[SwarmIDLabel], first)
+	assert.Equal(t, labels["foo"], "bar")
+	assert.Equal(t, container.SwarmID(), "swarm-id")
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestInspectContainer(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+
+	fresh := &dockerclient.ContainerInfo{Id: "one", Config: &dockerclient.ContainerConfig{Memory: 42, CpuShares: 1024}}
+	fresh.State.Running = true
+	client.On("InspectContainer", "one").Return(fresh, nil).Once()
+
+	info, err := engine.InspectContainer(container)
+	assert.NoError(t, err)
+	assert.True(t, info.State.Running)
+	assert.Equal(t, info.Config.Memory, 42)
+
+	// The cache is updated as a side effect.
+	cached := engine.Container("one")
+	assert.True(t, cached.Info.State.Running)
+	assert.Equal(t, cached.Info.Config.Memory, 42)
+	assert.Equal(t, cached.Info.Config.CpuShares, 1024*1024/mockInfo.NCPU)
+
+	_, err = engine.InspectContainer(&Container{Engine: NewEngine("other", 0)})
+	assert.Error(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestLockObserver(t *testing.T) {
+	engine, _ := benchmarkEngine(10)
+
+	ops := map[string]int{}
+	engine.SetLockObserver(func(op string, wait, held time.Duration) {
+		ops[op]++
+	})
+	engine.Containers()
+	engine.Containers()
+	assert.Equal(t, ops, map[string]int{"containers": 2})
+}
+
+func BenchmarkContainersLockWait(b *testing.B) {
+	engine, _ := benchmarkEngine(5000)
+
+	var (
+		mu    sync.Mutex
+		waits time.Duration
+		count int64
+	)
+	engine.SetLockObserver(func(op string, wait, held time.Duration) {
+		mu.Lock()
+		waits += wait
+		count++
+		mu.Unlock()
+	})
+
+	// Hold the write lock in the background, the way a refresh does.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				unlock := engine.observedLock("refresh_containers")
+				time.Sleep(10 * time.Microsecond)
+				unlock()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.Containers()
+	}
+	b.StopTimer()
+	close(done)
+
+	mu.Lock()
+	b.ReportMetric(float64(waits.Nanoseconds())/float64(count), "wait-ns/lock")
+	mu.Unlock()
+}
+
+// slowInspectClient simulates the latency of inspects and records how many
+// are running at once.
+type slowInspectClient struct {
+	*mockclient.MockClient
+	running, peak int32
+}
+
+func (c *slowInspectClient) InspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	running := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	for {
+		peak := atomic.LoadInt32(&c.peak)
+		if running <= peak || atomic.CompareAndSwapInt32(&c.peak, peak, running) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return c.MockClient.InspectContainer(id)
+}
+
+func TestRefreshContainersConcurrentInspects(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetInspectConcurrency(8)
+	client := &slowInspectClient{MockClient: mockclient.NewMockClient()}
+	engine.client = client
+
+	containers := make([]dockerclient.Container, 50)
+	for i := range containers {
+		id := fmt.Sprintf("%064d", i)
+		containers[i] = dockerclient.Container{Id: id}
+		client.On("InspectContainer", id).Return(&dockerclient.ContainerInfo{Id: id, Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	}
+	client.On("ListContainers", true, false, "").Return(containers, nil).Once()
+
+	assert.NoError(t, engine.refreshContainers(true))
+	assert.True(t, atomic.LoadInt32(&client.peak) > 1)
+	assert.True(t, atomic.LoadInt32(&client.peak) <= 8)
+
+	// Every container got its own inspect.
+	assert.Len(t, engine.Containers(), 50)
+	for _, c := range containers {
+		assert.Equal(t, engine.ContainerByID(c.Id).Info.Id, c.Id)
+	}
+	client.Mock.AssertExpectations(t)
+}
+
+func benchmarkFullRefresh(b *testing.B, concurrency int) {
+	engine := NewEngine("test", 0)
+	engine.SetInspectConcurrency(concurrency)
+	client := &slowInspectClient{MockClient: mockclient.NewMockClient()}
+	engine.client = client
+
+	containers := make([]dockerclient.Container, 100)
+	for i := range containers {
+		containers[i] = dockerclient.Container{Id: fmt.Sprintf("%064d", i)}
+	}
+	client.On("ListContainers", true, false, "").Return(containers, nil)
+	client.On("InspectContainer", mock.Anything).Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.refreshContainers(true)
+	}
+}
+
+func BenchmarkFullRefreshSerial(b *testing.B) {
+	benchmarkFullRefresh(b, 1)
+}
+
+func BenchmarkFullRefreshConcurrent(b *testing.B) {
+	benchmarkFullRefresh(b, defaultInspectConcurrency)
+}
+
+func BenchmarkRefreshContainers(b *testing.B) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	containers := make([]dockerclient.Container, 5000)
+	for i := range containers {
+		containers[i] = dockerclient.Container{Id: fmt.Sprintf("%064d", i)}
+		engine.AddContainer(&Container{Container: containers[i], Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, Engine: engine})
+	}
+	client.On("ListContainers", true, false, "").Return(containers, nil)
+
+	// Keep readers busy while refreshing.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				engine.UsedMemory()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.refreshContainers(false)
+	}
+	b.StopTimer()
+	close(done)
+}
+
+func TestRefreshNow(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	assert.Error(t, engine.RefreshNow())
+
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	assert.NoError(t, engine.connectClient(client))
+	assert.Len(t, engine.Containers(), 0)
+
+	// A container appears and is visible as soon as RefreshNow returns.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "one"}}, nil).Once()
+	client.On("InspectContainer", "one").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	assert.NoError(t, engine.RefreshNow())
+	assert.Len(t, engine.Containers(), 1)
+
+	// Errors are reported to the caller.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Once()
+	assert.Error(t, engine.RefreshNow())
+
+	// Once the refresh loop is gone, nobody is left to answer.
+	close(engine.stop)
+	<-engine.refreshDone
+	assert.Equal(t, engine.RefreshNow(), ErrShutdown)
+	engine.stop = make(chan struct{})
+	assert.Equal(t, engine.RefreshNow(), ErrNotConnected)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestRemoveImageSafe(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	image := &Image{Image: dockerclient.Image{Id: "image-id", RepoTags: []string{"busybox:latest"}}, Engine: engine}
+	unused := &Image{Image: dockerclient.Image{Id: "unused-id", RepoTags: []string{"redis:latest"}}, Engine: engine}
+	engine.addImage(image)
+	engine.addImage(unused)
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "one", Image: "busybox"}, Info: dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{Image: "busybox"}}, Engine: engine}))
+	assert.NoError(t, engine.AddContainer(&Container{Container: dockerclient.Container{Id: "two"}, Info: dockerclient.ContainerInfo{Image: "image-id", Config: &dockerclient.ContainerConfig{}}, Engine: engine}))
+
+	// The image is in use.
+	_, err := engine.RemoveImageSafe(image, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "one, two")
+
+	client.On("RemoveImage", "unused-id").Return([]*dockerclient.ImageDelete{{Deleted: "unused-id"}}, nil).Once()
+	_, err = engine.RemoveImageSafe(unused, false)
+	assert.NoError(t, err)
+
+	client.On("RemoveImage", "image-id").Return([]*dockerclient.ImageDelete{{Deleted: "image-id"}}, nil).Once()
+	_, err = engine.RemoveImageSafe(image, true)
+	assert.NoError(t, err)
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPullImageNames(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil)
+
+	for name, pulled := range map[string]string{
+		"busybox":                   "busybox:latest",
+		"busybox:1.0":               "busybox:1.0",
+		"registry:5000/busybox":     "registry:5000/busybox:latest",
+		"registry:5000/busybox:1.0": "registry:5000/busybox:1.0",
+		"busybox@sha256:abc":        "busybox@sha256:abc",
+	} {
+		client.On("PullImage", pulled, mock.Anything).Return(nil).Once()
+		assert.NoError(t, engine.Pull(name))
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPullDefaultTag(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.SetDefaultTag("stable")
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil)
+
+	for name, pulled := range map[string]string{
+		"busybox":                          "busybox:stable",
+		"busybox:1.0":                      "busybox:1.0",
+		"registry:5000/busybox":            "registry:5000/busybox:stable",
+		"registry:5000/busybox:1.0":        "registry:5000/busybox:1.0",
+		"busybox@sha256:abc":               "busybox@sha256:abc",
+		"registry:5000/busybox@sha256:abc": "registry:5000/busybox@sha256:abc",
+	} {
+		client.On("PullImage", pulled, mock.Anything).Return(nil).Once()
+		assert.NoError(t, engine.Pull(name))
+	}
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPullImages(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	auth := &dockerclient.AuthConfig{Username: "user"}
+	client.On("PullImage", "busybox:latest", auth).Return(nil).Once()
+	client.On("PullImage", "redis:3", auth).Return(errors.New("not found")).Once()
+	client.On("PullImage", "nginx:latest", auth).Return(nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{{Id: "busybox", RepoTags: []string{"busybox:latest"}}}, nil).Once()
+
+	errs := engine.PullImages([]string{"busybox", "redis:3", "nginx"}, auth)
+	assert.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], "not found")
+	assert.NoError(t, errs[2])
+	assert.NotNil(t, engine.Image("busybox"))
+
+	// Disconnected engines fail every pull.
+	errs = NewEngine("other", 0).PullImages([]string{"busybox", "nginx"}, nil)
+	assert.Equal(t, errs, []error{ErrNotConnected, ErrNotConnected})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestPullCredentials(t *testing.T) {
+	engine := NewEngine("test", 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil)
+
+	credentials := map[string]*dockerclient.AuthConfig{
+		"registry:5000": {Username: "private"},
+		"docker.io":     {Username: "hub"},
+	}
+	registries := []string{}
+	engine.SetCredentialProvider(func(registry string) (*dockerclient.AuthConfig, error) {
+		registries = append(registries, registry)
+		if auth, ok := credentials[registry]; ok {
+			return auth, nil
+		}
+		return nil, errors.New("no credentials")
+	})
+
+	client.On("PullImage", "registry:5000/busybox:latest", credentials["registry:5000"]).Return(nil).Once()
+	assert.NoError(t, engine.Pull("registry:5000/busybox"))
+	client.On("PullImage", "busybox:latest", credentials["docker.io"]).Return(nil).Once()
+	assert.NoError(t, engine.Pull("busybox"))
+
+	// Without credentials, the pull is not attempted.
+	assert.EqualError(t, engine.Pull("registry.io/busybox"), "no credentials")
+	assert.Equal(t, registries, []string{"registry:5000", "docker.io", "registry.io"})
+
+	client.Mock.AssertExpectations(t)
+}
+
+func TestHealthTimestamps(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	client := mockclient.NewMockClient()
+	client.On("Info").Return(mockInfo, nil)
+	client.On("StartMonitorEvents", mock.Anything, mock.Anything, mock.Anything).Return()
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+
+	before := time.Now()
+	assert.NoError(t, engine.connectClient(client))
+	connected := engine.LastUpdate()
+	assert.False(t, connected.Before(before))
+	assert.True(t, engine.UnhealthySince().IsZero())
+
+	// The engine goes down.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail")).Twice()
+	engine.refresh()
+	since := engine.UnhealthySince()
+	assert.False(t, since.IsZero())
+	assert.Equal(t, engine.LastUpdate(), connected)
+
+	// Still down, the transition time doesn't move.
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	newClient = func(string, *tls.Config) (dockerclient.Client, error) { return client, nil }
+	client.On("StopAllMonitorEvents").Return()
+	engine.refresh()
+	assert.Equal(t, engine.UnhealthySince(), since)
+
+	// Back to life.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, nil).Once()
+	client.On("ListImages").Return([]*dockerclient.Image{}, nil).Once()
+	client.On("ListVolumes").Return([]*dockerclient.Volume{}, nil).Once()
+	client.On("ListNetworks", "").Return([]*dockerclient.NetworkResource{}, nil).Once()
+	engine.refresh()
+	assert.True(t, engine.UnhealthySince().IsZero())
+	assert.True(t, engine.LastUpdate().After(connected))
+}
+
+func TestWaitHealthy(t *testing.T) {
+	engine := NewEngine("test", 0)
+	assert.NoError(t, engine.WaitHealthy(0))
+
+	engine.setHealthy(false)
+	assert.Error(t, engine.WaitHealthy(10*time.Millisecond))
+
+	// The engine comes back while waiting.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		engine.setHealthy(true)
+	}()
+	assert.NoError(t, engine.WaitHealthy(time.Second))
+}
+
+func TestMaxReconnectAttempts(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.SetClientRetries(1, 0)
+	client := mockclient.NewMockClient()
+	engine.client = client
+	engine.SetMaxReconnectAttempts(3)
+	handler := &recordingHandler{}
+	assert.NoError(t, engine.RegisterEventHandler(handler))
+
+	defer func(f func(string, *tls.Config) (dockerclient.Client, error)) { newClient = f }(newClient)
+	newClient = func(string, *tls.Config) (dockerclient.Client, error) { return client, nil }
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{}, errors.New("fail"))
+	client.On("StopAllMonitorEvents").Return()
+
+	done := make(chan struct{})
+	go func() {
+		engine.refreshLoop()
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		engine.refreshContainersAsync()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop did not terminate")
+	}
+	assert.False(t, engine.isConnected())
+	assert.False(t, engine.IsHealthy())
+	assert.Equal(t, handler.statuses(), []string{"engine_disconnect", "engine_removed"})
+	client.Mock.AssertNumberOfCalls(t, "ListContainers", 3)
+}
+
+func TestMatchLabel(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Labels = map[string]string{
+		"foo":     "bar=baz",
+		"storage": "ssd.fast",
+	}
+
+	assert.True(t, engine.MatchLabel("foo", "bar=baz"))
+	assert.False(t, engine.MatchLabel("foo", "bar"))
+	assert.True(t, engine.MatchLabel("foo", "bar=*"))
+	assert.True(t, engine.MatchLabel("storage", "ssd*"))
+	assert.False(t, engine.MatchLabel("storage", "ssd.f"))
+	// "." is not a wildcard.
+	assert.False(t, engine.MatchLabel("storage", "ssd?fast"))
+
+	// Negation.
+	assert.True(t, engine.MatchLabel("storage", "!hdd*"))
+	assert.False(t, engine.MatchLabel("storage", "!ssd*"))
+
+	// Missing labels only match negations.
+	assert.False(t, engine.MatchLabel("missing", "*"))
+	assert.True(t, engine.MatchLabel("missing", "!value"))
+}
+
+func TestDisconnectedEngine(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+	assert.NoError(t, engine.AddContainer(container))
+	image := &Image{Image: dockerclient.Image{Id: "image-id"}, Engine: engine}
+
+	// None of these may panic.
+	_, err := engine.Create(&dockerclient.ContainerConfig{}, "test", true)
+	assert.Error(t, err)
+	assert.Error(t, engine.Destroy(container, true, true))
+	assert.Len(t, engine.DestroyBatch([]*Container{container}, true, true), 1)
+	assert.Error(t, engine.Pull("busybox"))
+	_, err = engine.RemoveImage(image)
+	assert.Error(t, err)
+	assert.Error(t, engine.RefreshImages())
+	assert.Error(t, engine.RefreshVolumes())
+	assert.Error(t, engine.RefreshNetworks())
+	_, err = engine.Info()
+	assert.Error(t, err)
+	_, err = engine.CreateNetwork(&dockerclient.NetworkCreate{Name: "network"})
+	assert.Error(t, err)
+	assert.Error(t, engine.RemoveNetwork("network"))
+	assert.Error(t, engine.ConnectNetwork("network", container))
+	assert.Error(t, engine.DisconnectNetwork("network", container, false))
+	assert.Error(t, engine.UpdateResources(container, 1, 1))
+	_, err = engine.Wait(container)
+	assert.Error(t, err)
+	_, err = engine.Top(container, "")
+	assert.Error(t, err)
+	_, err = engine.Commit(container, "repo", "tag", nil)
+	assert.Error(t, err)
+	_, err = engine.Stats(container, func(*dockerclient.Stats) {})
+	assert.Error(t, err)
+	_, err = engine.InspectContainer(container)
+	assert.Error(t, err)
+	_, err = engine.Logs(container, &dockerclient.LogOptions{})
+	assert.Error(t, err)
+	assert.Error(t, engine.CopyToContainer(container, "/", strings.NewReader("")))
+	_, err = engine.CopyFromContainer(container, "/")
+	assert.Error(t, err)
+	assert.Len(t, engine.DrainContainers(10), 1)
+	assert.Error(t, engine.RefreshNow())
+}
+
+func TestEngineErrors(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	container := &Container{Container: dockerclient.Container{Id: "one"}, Engine: engine}
+
+	// Not connected.
+	_, err := engine.Create(&dockerclient.ContainerConfig{}, "test", false)
+	assert.Equal(t, err, ErrNotConnected)
+	assert.Equal(t, engine.RefreshNow(), ErrNotConnected)
+
+	// Containers.
+	assert.Equal(t, engine.removeContainer(container), ErrContainerNotFound)
+	assert.NoError(t, engine.AddContainer(container))
+	assert.Equal(t, engine.AddContainer(container), ErrContainerAlreadyExists)
+	other := &Container{Container: dockerclient.Container{Id: "one"}, Engine: NewEngine("other", 0)}
+	assert.Equal(t, engine.checkContainer(other), ErrContainerNotFound)
+	assert.NoError(t, engine.checkContainer(container))
+
+	// Images.
+	engine.Memory = 1024
+	assert.Equal(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox"}, "test", false), ErrImageNotFound)
+
+	// Cordoned engines.
+	engine.Cordon()
+	assert.Equal(t, engine.CanCreate(&dockerclient.ContainerConfig{Image: "busybox"}, "test", false), ErrCordoned)
+
+	// Event handlers.
+	assert.NoError(t, engine.RegisterEventHandler(&recordingHandler{}))
+	assert.Equal(t, engine.RegisterEventHandler(&recordingHandler{}), ErrEventHandlerAlreadySet)
+}
+
+func TestCreateBatch(t *testing.T) {
+	engine := NewEngine("test", 0)
+	engine.Cpus = mockInfo.NCPU
+	client := mockclient.NewMockClient()
+	engine.client = client
+
+	configs := []*dockerclient.ContainerConfig{{Image: "busybox"}, {Image: "busybox"}, {Image: "busybox"}}
+	names := []string{"one", "two", "three"}
+
+	client.On("CreateContainer", mock.Anything, "one").Return("id1", nil).Once()
+	client.On("CreateContainer", mock.Anything, "two").Return("", errors.New("fail")).Once()
+	client.On("CreateContainer", mock.Anything, "three").Return("id3", nil).Once()
+	// A single refresh picks up every created container.
+	client.On("ListContainers", true, false, "").Return([]dockerclient.Container{{Id: "id1"}, {Id: "id3"}}, nil).Once()
+	client.On("InspectContainer", "id1").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+	client.On("InspectContainer", "id3").Return(&dockerclient.ContainerInfo{Config: &dockerclient.ContainerConfig{}}, nil).Once()
+
+	containers, errs := engine.CreateBatch(configs, names, false)
+	assert.Len(t, containers, 3)
+	assert.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+	assert.NoError(t, errs[2])
+	assert.Equal(t, containers[0].Id, "id1")
+	assert.Nil(t, containers[1])
+	assert.Equal(t, containers[2].Id, "id3")
+	assert.Len(t, engine.Containers(), 2)
+
+	// Mismatched names are refused.
+	_, errs = engine.CreateBatch(configs, names[:1], false)
+	assert.Len(t, errs, 3)
+	assert.Error(t, errs[0])
+
+	client.Mock.AssertExpectations(t)
+}
@@ -5,7 +5,35 @@ import "github.com/samalba/dockerclient"
 // Event is exported
 type Event struct {
 	dockerclient.Event
-	Engine *Engine
+	Engine *Engine `json:"-"`
+
+	// Node identifies the engine the event comes from, it survives
+	// serialization unlike the Engine pointer.
+	Node EventNode
+
+	// Resize is only set on container_resize events.
+	Resize *ResourceChange
+
+	// RepoTags is only set on image_added and image_removed events.
+	RepoTags []string `json:",omitempty"`
+}
+
+// EventNode is the identity of the engine an event comes from.
+type EventNode struct {
+	ID     string            `json:"Id"`
+	Name   string            `json:"Name"`
+	IP     string            `json:"Ip"`
+	Addr   string            `json:"Addr"`
+	Labels map[string]string `json:"Labels,omitempty"`
+}
+
+// ResourceChange holds the reservations of a container before and after
+// its limits were updated.
+type ResourceChange struct {
+	OldMemory int64
+	NewMemory int64
+	OldCpus   int64
+	NewCpus   int64
 }
 
 // EventHandler is exported
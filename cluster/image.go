@@ -20,10 +20,112 @@ func (image *Image) Match(IDOrName string) bool {
 	if image.Id == IDOrName || (size > 2 && strings.HasPrefix(image.Id, IDOrName)) {
 		return true
 	}
+	name := normalizeImageName(IDOrName)
 	for _, repoTag := range image.RepoTags {
 		if repoTag == IDOrName || (size > 2 && strings.HasPrefix(repoTag, IDOrName)) {
 			return true
 		}
+		if normalizeImageName(repoTag) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if one of the tags of the image is in repository repo.
+func (image *Image) inRepository(repo string) bool {
+	name := parseImageReference(repo).name()
+	for _, repoTag := range image.RepoTags {
+		// Untagged images have no repository.
+		if repoTag == "<none>:<none>" {
+			continue
+		}
+		if parseImageReference(repoTag).name() == name {
+			return true
+		}
 	}
 	return false
 }
+
+// imageReference is a parsed image name: [registry/]repository[:tag][@digest]
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// Parse an image name. The registry is only recognized when the first
+// component of the name looks like a hostname (contains "." or ":", or is
+// "localhost"), so that a registry port is never taken for a tag.
+func parseImageReference(name string) imageReference {
+	var ref imageReference
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, name = host, name[i+1:]
+		}
+	}
+
+	// Registries are gone, any colon left separates the tag.
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+	ref.Repository = name
+
+	return ref
+}
+
+// Return the registry and repository of the reference, without tag nor
+// digest.
+func (ref imageReference) name() string {
+	return imageReference{Registry: ref.Registry, Repository: ref.Repository}.String()
+}
+
+func (ref imageReference) String() string {
+	name := ref.Repository
+	if ref.Registry != "" {
+		name = ref.Registry + "/" + name
+	}
+	if ref.Tag != "" {
+		name = name + ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		name = name + "@" + ref.Digest
+	}
+	return name
+}
+
+// The registry docker pulls from when an image name has none.
+const defaultRegistry = "docker.io"
+
+// Return the registry host of an image name.
+func imageRegistry(name string) string {
+	if registry := parseImageReference(name).Registry; registry != "" {
+		return registry
+	}
+	return defaultRegistry
+}
+
+// The tag docker assumes when an image name has none.
+const defaultImageTag = "latest"
+
+// Return the image name with the default tag when it has neither a tag nor
+// a digest.
+func normalizeImageName(name string) string {
+	return withDefaultTag(name, defaultImageTag)
+}
+
+// Return the image name with tag when it has neither a tag nor a digest.
+func withDefaultTag(name, tag string) string {
+	ref := parseImageReference(name)
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = tag
+	}
+	return ref.String()
+}
@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/samalba/dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageReference(t *testing.T) {
+	for name, expected := range map[string]imageReference{
+		"busybox":                          {Repository: "busybox"},
+		"busybox:1.0":                      {Repository: "busybox", Tag: "1.0"},
+		"user/busybox:1.0":                 {Repository: "user/busybox", Tag: "1.0"},
+		"registry:5000/busybox":            {Registry: "registry:5000", Repository: "busybox"},
+		"registry:5000/user/busybox:1.0":   {Registry: "registry:5000", Repository: "user/busybox", Tag: "1.0"},
+		"registry.io/busybox":              {Registry: "registry.io", Repository: "busybox"},
+		"localhost/busybox:1.0":            {Registry: "localhost", Repository: "busybox", Tag: "1.0"},
+		"busybox@sha256:abc":               {Repository: "busybox", Digest: "sha256:abc"},
+		"registry:5000/busybox@sha256:abc": {Registry: "registry:5000", Repository: "busybox", Digest: "sha256:abc"},
+	} {
+		ref := parseImageReference(name)
+		assert.Equal(t, ref, expected)
+		assert.Equal(t, ref.String(), name)
+	}
+}
+
+func TestNormalizeImageName(t *testing.T) {
+	assert.Equal(t, normalizeImageName("busybox"), "busybox:latest")
+	assert.Equal(t, normalizeImageName("busybox:1.0"), "busybox:1.0")
+	assert.Equal(t, normalizeImageName("registry:5000/busybox"), "registry:5000/busybox:latest")
+	assert.Equal(t, normalizeImageName("registry:5000/busybox:1.0"), "registry:5000/busybox:1.0")
+	assert.Equal(t, normalizeImageName("busybox@sha256:abc"), "busybox@sha256:abc")
+}
+
+func TestWithDefaultTag(t *testing.T) {
+	assert.Equal(t, withDefaultTag("busybox", "stable"), "busybox:stable")
+	assert.Equal(t, withDefaultTag("busybox:1.0", "stable"), "busybox:1.0")
+	assert.Equal(t, withDefaultTag("registry:5000/busybox", "stable"), "registry:5000/busybox:stable")
+	assert.Equal(t, withDefaultTag("registry:5000/busybox@sha256:abc", "stable"), "registry:5000/busybox@sha256:abc")
+}
+
+func TestImageRegistry(t *testing.T) {
+	assert.Equal(t, imageRegistry("busybox"), "docker.io")
+	assert.Equal(t, imageRegistry("user/busybox:1.0"), "docker.io")
+	assert.Equal(t, imageRegistry("registry:5000/busybox"), "registry:5000")
+	assert.Equal(t, imageRegistry("registry.io/user/busybox@sha256:abc"), "registry.io")
+}
+
+func TestImageMatch(t *testing.T) {
+	image := &Image{Image: dockerclient.Image{Id: "image-id", RepoTags: []string{"registry:5000/busybox:latest"}}}
+
+	assert.True(t, image.Match("image-id"))
+	assert.True(t, image.Match("registry:5000/busybox"))
+	assert.True(t, image.Match("registry:5000/busybox:latest"))
+	assert.False(t, image.Match("registry:5000/busybox:1.0"))
+	assert.False(t, image.Match("busybox"))
+}
@@ -0,0 +1,24 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/samalba/dockerclient"
+)
+
+// Network is exported
+type Network struct {
+	dockerclient.NetworkResource
+
+	Engine *Engine
+}
+
+// Match is exported
+func (network *Network) Match(IDOrName string) bool {
+	size := len(IDOrName)
+
+	if network.ID == IDOrName || (size > 2 && strings.HasPrefix(network.ID, IDOrName)) {
+		return true
+	}
+	return network.Name == IDOrName
+}
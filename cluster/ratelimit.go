@@ -0,0 +1,332 @@
+package cluster
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+// rateLimiter is a token bucket allowing `rate` calls per second, with bursts
+// of up to one second worth of calls.
+type rateLimiter struct {
+	sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rps int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rps),
+		tokens: float64(rps),
+		last:   time.Now(),
+	}
+}
+
+// Block until a call is allowed, or fail with ErrShutdown once stop is
+// closed. Tokens are taken in advance, so that callers are served in order.
+func (l *rateLimiter) wait(stop <-chan struct{}) error {
+	l.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		// Give the token back, the call is not made.
+		l.Lock()
+		l.tokens++
+		l.Unlock()
+		return ErrShutdown
+	}
+}
+
+// limitedClient is a client to the docker engine whose calls go through a
+// rate limiter. The calls still waiting when stop is closed fail with
+// ErrShutdown, or return without effect if they return no error.
+type limitedClient struct {
+	dockerclient.Client
+
+	limiter *rateLimiter
+	stop    <-chan struct{}
+}
+
+func (c *limitedClient) wait() error {
+	return c.limiter.wait(c.stop)
+}
+
+func (c *limitedClient) Info() (*dockerclient.Info, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.Info()
+}
+
+func (c *limitedClient) ListContainers(all, size bool, filters string) ([]dockerclient.Container, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ListContainers(all, size, filters)
+}
+
+func (c *limitedClient) InspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.InspectContainer(id)
+}
+
+func (c *limitedClient) CreateContainer(config *dockerclient.ContainerConfig, name string) (string, error) {
+	if err := c.wait(); err != nil {
+		return "", err
+	}
+	return c.Client.CreateContainer(config, name)
+}
+
+func (c *limitedClient) ContainerLogs(id string, options *dockerclient.LogOptions) (io.ReadCloser, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ContainerLogs(id, options)
+}
+
+func (c *limitedClient) ContainerChanges(id string) ([]*dockerclient.ContainerChanges, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ContainerChanges(id)
+}
+
+func (c *limitedClient) Exec(config *dockerclient.ExecConfig) (string, error) {
+	if err := c.wait(); err != nil {
+		return "", err
+	}
+	return c.Client.Exec(config)
+}
+
+func (c *limitedClient) StartContainer(id string, config *dockerclient.HostConfig) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.StartContainer(id, config)
+}
+
+func (c *limitedClient) StopContainer(id string, timeout int) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.StopContainer(id, timeout)
+}
+
+func (c *limitedClient) RestartContainer(id string, timeout int) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.RestartContainer(id, timeout)
+}
+
+func (c *limitedClient) KillContainer(id, signal string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.KillContainer(id, signal)
+}
+
+func (c *limitedClient) StartMonitorEvents(cb dockerclient.Callback, ec chan error, args ...interface{}) {
+	if c.wait() != nil {
+		return
+	}
+	c.Client.StartMonitorEvents(cb, ec, args...)
+}
+
+func (c *limitedClient) StartMonitorEventsSince(since int64, cb dockerclient.Callback, ec chan error, args ...interface{}) {
+	if c.wait() != nil {
+		return
+	}
+	c.Client.StartMonitorEventsSince(since, cb, ec, args...)
+}
+
+func (c *limitedClient) StartMonitorStats(id string, cb dockerclient.StatCallback, ec chan error, args ...interface{}) {
+	if c.wait() != nil {
+		return
+	}
+	c.Client.StartMonitorStats(id, cb, ec, args...)
+}
+
+func (c *limitedClient) Version() (*dockerclient.Version, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.Version()
+}
+
+func (c *limitedClient) PullImage(name string, auth *dockerclient.AuthConfig) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.PullImage(name, auth)
+}
+
+func (c *limitedClient) LoadImage(reader io.Reader) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.LoadImage(reader)
+}
+
+func (c *limitedClient) RemoveContainer(id string, force, volumes bool) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.RemoveContainer(id, force, volumes)
+}
+
+func (c *limitedClient) ListImages() ([]*dockerclient.Image, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ListImages()
+}
+
+func (c *limitedClient) RemoveImage(name string) ([]*dockerclient.ImageDelete, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.RemoveImage(name)
+}
+
+func (c *limitedClient) PauseContainer(name string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.PauseContainer(name)
+}
+
+func (c *limitedClient) UnpauseContainer(name string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.UnpauseContainer(name)
+}
+
+func (c *limitedClient) UpdateContainer(id string, config *dockerclient.UpdateConfig) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.UpdateContainer(id, config)
+}
+
+func (c *limitedClient) WaitContainer(id string) (int, error) {
+	if err := c.wait(); err != nil {
+		return 0, err
+	}
+	return c.Client.WaitContainer(id)
+}
+
+func (c *limitedClient) CommitContainer(id, repo, tag string, config *dockerclient.ContainerConfig) (string, error) {
+	if err := c.wait(); err != nil {
+		return "", err
+	}
+	return c.Client.CommitContainer(id, repo, tag, config)
+}
+
+func (c *limitedClient) TopContainer(id, psArgs string) (*dockerclient.ContainerProcessList, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.TopContainer(id, psArgs)
+}
+
+func (c *limitedClient) ListVolumes() ([]*dockerclient.Volume, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ListVolumes()
+}
+
+func (c *limitedClient) ListNetworks(filters string) ([]*dockerclient.NetworkResource, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ListNetworks(filters)
+}
+
+func (c *limitedClient) CreateNetwork(config *dockerclient.NetworkCreate) (*dockerclient.NetworkCreateResponse, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.CreateNetwork(config)
+}
+
+func (c *limitedClient) RemoveNetwork(id string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.RemoveNetwork(id)
+}
+
+func (c *limitedClient) ConnectNetwork(id, container string) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.ConnectNetwork(id, container)
+}
+
+func (c *limitedClient) DisconnectNetwork(id, container string, force bool) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.DisconnectNetwork(id, container, force)
+}
+
+func (c *limitedClient) PutArchive(id, path string, content io.Reader) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.PutArchive(id, path, content)
+}
+
+func (c *limitedClient) GetArchive(id, path string) (io.ReadCloser, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.GetArchive(id, path)
+}
+
+func (c *limitedClient) RemoveVolume(name string, force bool) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.RemoveVolume(name, force)
+}
+
+func (c *limitedClient) Ping() error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.Client.Ping()
+}
+
+func (c *limitedClient) ContainerStats(id string) (io.ReadCloser, error) {
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	return c.Client.ContainerStats(id)
+}
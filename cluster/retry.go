@@ -0,0 +1,26 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	defaultClientRetries = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+)
+
+// Call fn up to n times until it succeeds, waiting backoff before the first
+// retry and twice as long before each of the next ones. Only meant for
+// idempotent calls. Not found errors are not transient and returned at once,
+// as are the calls aborted by a shutdown.
+func retry(n int, backoff time.Duration, fn func() error) error {
+	err := fn()
+	for i := 1; i < n && err != nil && err != dockerclient.ErrNotFound && err != ErrShutdown; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
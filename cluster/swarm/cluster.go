@@ -1,7 +1,6 @@
 package swarm
 
 import (
-	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -61,6 +60,13 @@ func NewCluster(scheduler *scheduler.Scheduler, store *state.Store, options *clu
 
 // Handle callbacks for the events
 func (c *Cluster) Handle(e *cluster.Event) error {
+	// Forget about engines which were given up on.
+	if e.Status == "engine_removed" {
+		c.Lock()
+		delete(c.engines, e.Engine.ID)
+		c.Unlock()
+	}
+
 	if c.eventHandler == nil {
 		return nil
 	}
@@ -73,7 +79,7 @@ func (c *Cluster) Handle(e *cluster.Event) error {
 // RegisterEventHandler registers an event handler.
 func (c *Cluster) RegisterEventHandler(h cluster.EventHandler) error {
 	if c.eventHandler != nil {
-		return errors.New("event handler already set")
+		return cluster.ErrEventHandlerAlreadySet
 	}
 	c.eventHandler = h
 	return nil
@@ -112,7 +118,7 @@ func (c *Cluster) RemoveContainer(container *cluster.Container, force bool) erro
 	c.scheduler.Lock()
 	defer c.scheduler.Unlock()
 
-	if err := container.Engine.Destroy(container, force); err != nil {
+	if err := container.Engine.Destroy(container, force, true); err != nil {
 		return err
 	}
 
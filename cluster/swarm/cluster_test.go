@@ -46,3 +46,16 @@ func TestContainerLookup(t *testing.T) {
 	assert.NotNil(t, c.Container("test-engine/container-name1"))
 	assert.NotNil(t, c.Container("test-engine/container-name2"))
 }
+
+func TestHandleEngineRemoved(t *testing.T) {
+	c := &Cluster{
+		engines: make(map[string]*cluster.Engine),
+	}
+	n := createEngine(t, "test-engine")
+	c.engines[n.ID] = n
+
+	assert.NoError(t, c.Handle(&cluster.Event{Event: dockerclient.Event{Status: "engine_disconnect"}, Engine: n}))
+	assert.Len(t, c.engines, 1)
+	assert.NoError(t, c.Handle(&cluster.Event{Event: dockerclient.Event{Status: "engine_removed"}, Engine: n}))
+	assert.Len(t, c.engines, 0)
+}
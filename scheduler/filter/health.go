@@ -12,7 +12,8 @@ var (
 	ErrNoHealthyNodeAvailable = errors.New("No healthy node available in the cluster")
 )
 
-// HealthFilter only schedules containers on healthy nodes.
+// HealthFilter only schedules containers on healthy nodes that are not
+// cordoned.
 type HealthFilter struct {
 }
 
@@ -25,7 +26,7 @@ func (f *HealthFilter) Name() string {
 func (f *HealthFilter) Filter(_ *dockerclient.ContainerConfig, nodes []*node.Node) ([]*node.Node, error) {
 	result := []*node.Node{}
 	for _, node := range nodes {
-		if node.IsHealthy {
+		if node.IsHealthy && !node.IsCordoned {
 			result = append(result, node)
 		}
 	}
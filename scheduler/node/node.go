@@ -24,7 +24,8 @@ type Node struct {
 	TotalMemory int64
 	TotalCpus   int64
 
-	IsHealthy bool
+	IsHealthy  bool
+	IsCordoned bool
 }
 
 // NewNode creates a node from an engine
@@ -43,6 +44,7 @@ func NewNode(e *cluster.Engine) *Node {
 		TotalMemory: e.TotalMemory(),
 		TotalCpus:   e.TotalCpus(),
 		IsHealthy:   e.IsHealthy(),
+		IsCordoned:  e.IsCordoned(),
 	}
 }
 
@@ -73,8 +75,8 @@ func (n *Node) Container(IDOrName string) *cluster.Container {
 // AddContainer inject a container into the internal state.
 func (n *Node) AddContainer(container *cluster.Container) error {
 	if container.Info.Config != nil {
-		memory := container.Info.Config.Memory
-		cpus := container.Info.Config.CpuShares
+		memory := container.ReservedMemory()
+		cpus := container.ReservedCpus()
 		if n.TotalMemory-memory < 0 || n.TotalCpus-cpus < 0 {
 			return errors.New("not enough resources")
 		}